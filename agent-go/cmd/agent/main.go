@@ -1,14 +1,27 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"minebot-agent/internal/config"
 	"minebot-agent/internal/ws"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(validate(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "maintenance" {
+		os.Exit(maintenance(os.Args[2:]))
+	}
+
 	cfgPath := flag.String("config", "config.yml", "config file path")
 	flag.Parse()
 
@@ -16,11 +29,101 @@ func main() {
 	if err != nil {
 		log.Fatalf("load config failed: %v", err)
 	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("invalid config: %v", err)
+	}
 
 	client := ws.NewClient(cfg)
 	if err := client.Connect(); err != nil {
 		log.Fatalf("connect failed: %v", err)
 	}
 
+	go watchConfig(*cfgPath, client)
+	go watchMaintenanceSignals(client)
 	client.Run()
 }
+
+func maintenance(args []string) int {
+	fs := flag.NewFlagSet("maintenance", flag.ExitOnError)
+	cfgPath := fs.String("config", "config.yml", "config file path")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: minebot-agent maintenance [-config path] on|off|status")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	cfg, err := config.Load(*cfgPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *cfgPath, err)
+		return 1
+	}
+	flagFile := cfg.Maintenance.FlagFile
+	switch fs.Arg(0) {
+	case "on":
+		err = os.WriteFile(flagFile, []byte(time.Now().UTC().Format(time.RFC3339)+"\n"), 0644)
+	case "off":
+		err = os.Remove(flagFile)
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+	case "status":
+	default:
+		fs.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", flagFile, err)
+		return 1
+	}
+	_, statErr := os.Stat(flagFile)
+	fmt.Printf("maintenance flag %s: %v (config enabled: %v)\n", flagFile, statErr == nil, cfg.Maintenance.Enabled)
+	return 0
+}
+
+func validate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	cfgPath := fs.String("config", "config.yml", "config file path")
+	_ = fs.Parse(args)
+
+	err := config.Check(*cfgPath)
+	var verr *config.ValidationError
+	if errors.As(err, &verr) {
+		for _, p := range verr.Problems {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", *cfgPath, p)
+		}
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *cfgPath, err)
+		return 1
+	}
+	fmt.Printf("%s: ok\n", *cfgPath)
+	return 0
+}
+
+func watchConfig(path string, client *ws.Client) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	changed := config.Watch(path, 5*time.Second)
+	for {
+		select {
+		case <-hup:
+		case <-changed:
+		}
+		cfg, err := config.Load(path)
+		if err != nil {
+			log.Printf("reload config failed: %v", err)
+			continue
+		}
+		if err := cfg.Validate(); err != nil {
+			log.Printf("reload config rejected: %v", err)
+			continue
+		}
+		client.Reload(cfg)
+		log.Printf("config reloaded")
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"minebot-agent/internal/ws"
+)
+
+// SIGUSR1 enters maintenance mode, SIGUSR2 leaves it.
+func watchMaintenanceSignals(client *ws.Client) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1, syscall.SIGUSR2)
+	for sig := range ch {
+		client.SetMaintenance(sig == syscall.SIGUSR1)
+	}
+}
@@ -0,0 +1,7 @@
+//go:build windows
+
+package main
+
+import "minebot-agent/internal/ws"
+
+func watchMaintenanceSignals(client *ws.Client) {}
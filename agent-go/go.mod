@@ -1,12 +1,14 @@
 module minebot-agent
 
-go 1.21
+go 1.22
 
 require (
 	github.com/google/uuid v1.6.0
 	github.com/gorcon/rcon v1.3.3
 	github.com/gorilla/websocket v1.5.1
+	github.com/klauspost/compress v1.18.0
 	github.com/shirou/gopsutil/v3 v3.24.1
+	github.com/ulikunitz/xz v0.5.17
 	gopkg.in/yaml.v3 v3.0.1
 )
 
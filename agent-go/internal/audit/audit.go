@@ -0,0 +1,287 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const genesisHash = "0000000000000000000000000000000000000000000000000000000000000000"
+
+type Entry struct {
+	Seq        uint64   `json:"seq"`
+	Ts         string   `json:"ts"`
+	RequestID  string   `json:"requestId"`
+	Action     string   `json:"action"`
+	ServerID   string   `json:"serverId,omitempty"`
+	Scope      string   `json:"scope,omitempty"`
+	Paths      []string `json:"paths,omitempty"`
+	Command    string   `json:"command,omitempty"`
+	Success    bool     `json:"success"`
+	Message    string   `json:"message,omitempty"`
+	DurationMs int64    `json:"durationMs"`
+	Prev       string   `json:"prev"`
+	Hash       string   `json:"hash,omitempty"`
+}
+
+// Log is an append-only JSONL file where every entry carries the hash of
+// the previous one, so editing or dropping a line breaks the chain.
+type Log struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+	seq      uint64
+	prev     string
+}
+
+func Open(path string, maxSize int64, maxFiles int) (*Log, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, err
+	}
+	l := &Log{path: path, maxSize: maxSize, maxFiles: maxFiles, prev: genesisHash}
+	if last, err := lastEntry(l.files()); err != nil {
+		return nil, err
+	} else if last != nil {
+		l.seq = last.Seq
+		l.prev = last.Hash
+	}
+	if err := l.openFile(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) Path() string {
+	return l.path
+}
+
+// Close closes the file entries are appended to. Queries still running, or
+// started later, keep working since they open the files themselves.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+func (l *Log) Append(e Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return errors.New("audit log closed")
+	}
+
+	l.seq++
+	e.Seq = l.seq
+	if e.Ts == "" {
+		e.Ts = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	e.Prev = l.prev
+	e.Hash = ""
+	hash, err := hashEntry(e)
+	if err != nil {
+		return err
+	}
+	e.Hash = hash
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+	l.prev = hash
+	return nil
+}
+
+type Filter struct {
+	Action   string
+	ServerID string
+	// Servers, when set, limits results to entries whose server matches one
+	// of these path.Match patterns.
+	Servers []string
+	Offset  int
+	Limit   int
+}
+
+type Page struct {
+	Entries    []Entry `json:"entries"`
+	Total      int     `json:"total"`
+	ChainValid bool    `json:"chainValid"`
+	BrokenAt   uint64  `json:"brokenAt,omitempty"`
+}
+
+// Query reads all retained files oldest first, verifies the hash chain and
+// returns the matching entries between Offset and Offset+Limit. The lock is
+// only held to list the files, so appends and Close do not wait for the
+// scan.
+func (l *Log) Query(f Filter) (*Page, error) {
+	l.mu.Lock()
+	files := l.files()
+	l.mu.Unlock()
+
+	page := &Page{Entries: []Entry{}, ChainValid: true}
+	prev := ""
+	err := scan(files, func(e Entry) {
+		if page.ChainValid {
+			want, _ := hashEntry(withoutHash(e))
+			if want != e.Hash || (prev != "" && e.Prev != prev) {
+				page.ChainValid = false
+				page.BrokenAt = e.Seq
+			}
+		}
+		prev = e.Hash
+		if (f.Action != "" && e.Action != f.Action) || (f.ServerID != "" && e.ServerID != f.ServerID) {
+			return
+		}
+		if f.Servers != nil && !matchAny(f.Servers, e.ServerID) {
+			return
+		}
+		if page.Total >= f.Offset && len(page.Entries) < f.Limit {
+			page.Entries = append(page.Entries, e)
+		}
+		page.Total++
+	})
+	if err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+func (l *Log) openFile() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	l.file = f
+	l.size = info.Size()
+	return nil
+}
+
+func (l *Log) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	l.file = nil
+	for i := l.maxFiles - 1; i >= 1; i-- {
+		from := fmt.Sprintf("%s.%d", l.path, i)
+		if i == l.maxFiles-1 {
+			_ = os.Remove(from)
+			continue
+		}
+		_ = os.Rename(from, fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	if l.maxFiles > 1 {
+		if err := os.Rename(l.path, l.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(l.path); err != nil {
+		return err
+	}
+	return l.openFile()
+}
+
+// files lists the retained log files, oldest first.
+func (l *Log) files() []string {
+	var out []string
+	for i := l.maxFiles - 1; i >= 1; i-- {
+		p := fmt.Sprintf("%s.%d", l.path, i)
+		if _, err := os.Stat(p); err == nil {
+			out = append(out, p)
+		}
+	}
+	return append(out, l.path)
+}
+
+func scan(files []string, fn func(Entry)) error {
+	for _, p := range files {
+		f, err := os.Open(p)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		sc := bufio.NewScanner(f)
+		sc.Buffer(make([]byte, 64*1024), 4*1024*1024)
+		for sc.Scan() {
+			line := bytes.TrimSpace(sc.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			var e Entry
+			if err := json.Unmarshal(line, &e); err != nil {
+				// keep the chain check meaningful for garbled lines
+				e = Entry{Hash: "invalid"}
+			}
+			fn(e)
+		}
+		err = sc.Err()
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func lastEntry(files []string) (*Entry, error) {
+	var last *Entry
+	err := scan(files, func(e Entry) {
+		last = &e
+	})
+	return last, err
+}
+
+func matchAny(patterns []string, serverID string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, serverID); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func withoutHash(e Entry) Entry {
+	e.Hash = ""
+	return e
+}
+
+func hashEntry(e Entry) (string, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
+	"strconv"
 )
 
 func Sign(token, payload string) string {
@@ -11,3 +12,12 @@ func Sign(token, payload string) string {
 	mac.Write([]byte(payload))
 	return hex.EncodeToString(mac.Sum(nil))
 }
+
+func Verify(token, payload, sig string) bool {
+	return hmac.Equal([]byte(Sign(token, payload)), []byte(sig))
+}
+
+// RequestPayload is what the panel signs with a scoped token for each REQ.
+func RequestPayload(id, action string, ts int64, body []byte) string {
+	return id + action + strconv.FormatInt(ts, 10) + string(body)
+}
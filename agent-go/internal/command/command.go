@@ -0,0 +1,197 @@
+package command
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"minebot-agent/internal/config"
+)
+
+// validName is what a command name may look like once its namespace is
+// stripped. Anything else (quotes, escapes) could be read differently by the
+// server than by the rules, so it is refused.
+var validName = regexp.MustCompile(`^[a-z0-9_.\-]+$`)
+
+type layer struct {
+	name  string
+	rules []config.CommandRule
+}
+
+// Check decides whether cmd may be sent to the server console. Server rules
+// are consulted first and decide on any match; otherwise global rules apply.
+// Within a layer deny rules win over allow rules. When no allow rule exists
+// anywhere every command not denied is allowed. Commands nested in
+// "execute ... run" must pass as well.
+func Check(serverRules, globalRules []config.CommandRule, allowlist []string, cmd string) error {
+	if strings.ContainsAny(cmd, "\r\n\x00") {
+		return fmt.Errorf("command rejected: contains control characters")
+	}
+	name, args := Parse(cmd)
+	if name == "" {
+		return fmt.Errorf("command rejected: empty command")
+	}
+	if !validName.MatchString(name) {
+		return fmt.Errorf("command rejected: invalid command name %q", name)
+	}
+	global := append([]config.CommandRule{}, globalRules...)
+	global = append(global, FromAllowlist(allowlist)...)
+	if err := check(serverRules, global, name, args, false); err != nil {
+		return err
+	}
+	for _, nested := range nestedCommands(name, args) {
+		if err := Check(serverRules, globalRules, allowlist, nested); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckExec decides whether argv may be run in the container. Rules match
+// the program's base name and the arguments joined by spaces, with any
+// argument containing spaces or quotes single-quoted. Unlike Check, a
+// program is only allowed when an allow rule matches it.
+func CheckExec(serverRules, globalRules []config.CommandRule, argv []string) error {
+	if len(argv) == 0 || argv[0] == "" {
+		return fmt.Errorf("command rejected: empty command")
+	}
+	for _, a := range argv {
+		if strings.ContainsRune(a, '\x00') {
+			return fmt.Errorf("command rejected: contains control characters")
+		}
+	}
+	name := strings.ToLower(path.Base(argv[0]))
+	return check(serverRules, globalRules, name, JoinArgs(argv[1:]), true)
+}
+
+// JoinArgs joins args with spaces, single-quoting those that contain
+// whitespace or quotes so that rule patterns see argument boundaries.
+func JoinArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		if a == "" || strings.ContainsAny(a, " \t\n\r'\"\\") {
+			a = "'" + strings.ReplaceAll(a, "'", `'\''`) + "'"
+		}
+		quoted[i] = a
+	}
+	return strings.Join(quoted, " ")
+}
+
+func check(serverRules, globalRules []config.CommandRule, name, args string, requireAllow bool) error {
+	layers := []layer{{"server", serverRules}, {"global", globalRules}}
+
+	hasAllow := requireAllow
+	for _, l := range layers {
+		var allowed *config.CommandRule
+		for i := range l.rules {
+			r := &l.rules[i]
+			if r.Effect != "deny" {
+				hasAllow = true
+			}
+			ok, err := matches(r, name, args)
+			if err != nil {
+				return fmt.Errorf("command rejected: %v", err)
+			}
+			if !ok {
+				continue
+			}
+			if r.Effect == "deny" {
+				return fmt.Errorf("command %q denied by %s rule %s", name, l.name, describe(r))
+			}
+			if allowed == nil {
+				allowed = r
+			}
+		}
+		if allowed != nil {
+			return nil
+		}
+	}
+	if hasAllow {
+		return fmt.Errorf("command %q is not allowlisted", name)
+	}
+	return nil
+}
+
+// Parse splits a console command into its lower-cased name and arguments.
+// The name ends at the first whitespace of any kind and loses its namespace,
+// so "minecraft:op\tbob" parses as op with argument bob.
+func Parse(cmd string) (string, string) {
+	cmd = strings.TrimPrefix(strings.TrimSpace(cmd), "/")
+	name, args := cmd, ""
+	if i := strings.IndexFunc(cmd, unicode.IsSpace); i >= 0 {
+		name, args = cmd[:i], cmd[i:]
+	}
+	return normalizeName(name), strings.TrimSpace(args)
+}
+
+func normalizeName(name string) string {
+	if i := strings.LastIndexByte(name, ':'); i >= 0 {
+		name = name[i+1:]
+	}
+	return strings.ToLower(name)
+}
+
+// nestedCommands returns what an execute command may run: the text after
+// every "run" word. Taking each one, not just the first, keeps a selector
+// or name that happens to be "run" from hiding the real command.
+func nestedCommands(name, args string) []string {
+	if name != "execute" {
+		return nil
+	}
+	var nested []string
+	rest := args
+	for rest != "" {
+		word := rest
+		next := ""
+		if i := strings.IndexFunc(rest, unicode.IsSpace); i >= 0 {
+			word, next = rest[:i], strings.TrimLeftFunc(rest[i:], unicode.IsSpace)
+		}
+		if word == "run" && next != "" {
+			nested = append(nested, next)
+		}
+		rest = next
+	}
+	return nested
+}
+
+// FromAllowlist converts legacy commandAllowlist entries into allow rules.
+// "whitelist add" allows the whitelist command whose arguments start with
+// the word add, rather than any command sharing the raw prefix.
+func FromAllowlist(list []string) []config.CommandRule {
+	rules := make([]config.CommandRule, 0, len(list))
+	for _, entry := range list {
+		name, args := Parse(entry)
+		if name == "" {
+			continue
+		}
+		r := config.CommandRule{Effect: "allow", Command: name}
+		if args != "" {
+			r.Args = regexp.QuoteMeta(args) + `(\s.*)?`
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+func matches(r *config.CommandRule, name, args string) (bool, error) {
+	if r.Command != "*" && normalizeName(r.Command) != name {
+		return false, nil
+	}
+	if r.Args == "" {
+		return true, nil
+	}
+	re, err := regexp.Compile(`^(?:` + r.Args + `)$`)
+	if err != nil {
+		return false, err
+	}
+	return re.MatchString(args), nil
+}
+
+func describe(r *config.CommandRule) string {
+	if r.Args == "" {
+		return r.Effect + " " + r.Command
+	}
+	return fmt.Sprintf("%s %s /%s/", r.Effect, r.Command, r.Args)
+}
@@ -1,9 +1,26 @@
 package config
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
 	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
 
 	"gopkg.in/yaml.v3"
+
+	"minebot-agent/internal/protocol"
+)
+
+const (
+	ConsoleInputAuto = "auto"
+	ConsoleInputRcon = "rcon"
+	ConsoleInputExec = "exec"
 )
 
 type Config struct {
@@ -12,11 +29,39 @@ type Config struct {
 	WSURL             string            `yaml:"wsUrl"`
 	DockerBin         string            `yaml:"dockerBin"`
 	ContainerLabelKey string            `yaml:"containerLabelKey"`
-	ContainerMap      map[string]string `yaml:"containerMap"`
-	VolumeMap         map[string]string `yaml:"volumeMap"`
 	FileRoot          string            `yaml:"fileRoot"`
+	Servers           []ServerConfig    `yaml:"servers"`
 	Rcon              RconConfig        `yaml:"rcon"`
 	Security          SecurityConfig    `yaml:"security"`
+	Policy            PolicyConfig      `yaml:"policy"`
+	Tokens            []TokenConfig     `yaml:"tokens"`
+	Audit             AuditConfig       `yaml:"audit"`
+	Maintenance       MaintenanceConfig `yaml:"maintenance"`
+	Transfers         TransferConfig    `yaml:"transfers"`
+	Fetch             FetchConfig       `yaml:"fetch"`
+
+	// Legacy per-server maps, folded into Servers by Load.
+	ContainerMap map[string]string `yaml:"containerMap"`
+	VolumeMap    map[string]string `yaml:"volumeMap"`
+}
+
+type ServerConfig struct {
+	ID               string        `yaml:"id"`
+	Container        string        `yaml:"container"`
+	Label            string        `yaml:"label"`
+	Volume           string        `yaml:"volume"`
+	Rcon             *RconConfig   `yaml:"rcon"`
+	ConsoleInput     string        `yaml:"consoleInput"`
+	ExecShell        bool          `yaml:"execShell"`
+	AllowExec        bool          `yaml:"allowExec"`
+	ExecRules        []CommandRule `yaml:"execRules"`
+	CommandAllowlist []string      `yaml:"commandAllowlist"`
+	CommandRules     []CommandRule `yaml:"commandRules"`
+	AllowActions     []string      `yaml:"allowActions"`
+	Protect          ProtectConfig `yaml:"protect"`
+
+	// legacy marks entries that only come from containerMap/volumeMap.
+	legacy bool
 }
 
 type RconConfig struct {
@@ -27,20 +72,160 @@ type RconConfig struct {
 }
 
 type SecurityConfig struct {
-	AllowActions     []string `yaml:"allowActions"`
-	CommandAllowlist []string `yaml:"commandAllowlist"`
+	AllowActions     []string      `yaml:"allowActions"`
+	CommandAllowlist []string      `yaml:"commandAllowlist"`
+	CommandRules     []CommandRule `yaml:"commandRules"`
+	ExecRules        []CommandRule `yaml:"execRules"`
+	Protect          ProtectConfig `yaml:"protect"`
+	Extract          ExtractConfig `yaml:"extract"`
+}
+
+// ExtractConfig limits what DECOMPRESS may write. Zero values use the
+// agent defaults.
+type ExtractConfig struct {
+	MaxBytes   int64   `yaml:"maxBytes"`
+	MaxEntries int     `yaml:"maxEntries"`
+	MaxRatio   float64 `yaml:"maxRatio"`
+}
+
+// ProtectConfig holds glob patterns, relative to a server volume, that file
+// actions may never read, write or delete. Server patterns add to the
+// global ones.
+type ProtectConfig struct {
+	ReadDeny   []string `yaml:"readDeny"`
+	WriteDeny  []string `yaml:"writeDeny"`
+	DeleteDeny []string `yaml:"deleteDeny"`
+}
+
+// CommandRule matches a console command by exact name ("*" for any) and an
+// optional regular expression that must match the whole argument string.
+type CommandRule struct {
+	Effect  string `yaml:"effect"`
+	Command string `yaml:"command"`
+	Args    string `yaml:"args"`
+}
+
+// TokenConfig is a named panel scope. When any are configured, every REQ
+// must name one and be signed with its token.
+type TokenConfig struct {
+	Name    string   `yaml:"name"`
+	Token   string   `yaml:"token"`
+	Actions []string `yaml:"actions"`
+	Servers []string `yaml:"servers"`
+	Revoked bool     `yaml:"revoked"`
+}
+
+// MaintenanceConfig freezes the node to read-only actions. It is on when Enabled
+// is set, when FlagFile exists, or when toggled by signal.
+type MaintenanceConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	FlagFile string `yaml:"flagFile"`
+}
+
+// TransferConfig bounds upload and download sessions. Zero values use the
+// agent defaults.
+type TransferConfig struct {
+	IdleTimeoutSec        int `yaml:"idleTimeoutSec"`
+	MaxUploadsPerServer   int `yaml:"maxUploadsPerServer"`
+	MaxDownloadsPerServer int `yaml:"maxDownloadsPerServer"`
+	// MaxChunkSize caps the chunk size and range length of downloads.
+	MaxChunkSize int `yaml:"maxChunkSize"`
+}
+
+// FetchConfig controls FETCH_URL. It is disabled until AllowHosts lists at
+// least one host pattern; zero limits use the agent defaults.
+type FetchConfig struct {
+	AllowHosts   []string `yaml:"allowHosts"`
+	MaxBytes     int64    `yaml:"maxBytes"`
+	MaxRedirects int      `yaml:"maxRedirects"`
+	TimeoutSec   int      `yaml:"timeoutSec"`
+}
+
+type AuditConfig struct {
+	Disabled  bool   `yaml:"disabled"`
+	Path      string `yaml:"path"`
+	MaxSizeMB int    `yaml:"maxSizeMB"`
+	MaxFiles  int    `yaml:"maxFiles"`
+}
+
+type PolicyConfig struct {
+	// Default is "allow" or "deny"; empty means deny once any rule exists.
+	Default string       `yaml:"default"`
+	Rules   []PolicyRule `yaml:"rules"`
+}
+
+type PolicyRule struct {
+	Effect  string   `yaml:"effect" json:"effect"`
+	Servers []string `yaml:"servers" json:"servers,omitempty"`
+	Actions []string `yaml:"actions" json:"actions,omitempty"`
+	Paths   []string `yaml:"paths" json:"paths,omitempty"`
 }
 
+// Load reads the config file and applies overrides. Precedence, highest
+// first: MINEBOT_AGENT_<FIELD>, MINEBOT_AGENT_<FIELD>_FILE, the file value
+// (with ${NAME} taken from NAME, else the file at NAME_FILE), then built-in
+// defaults.
 func Load(path string) (*Config, error) {
-	data, err := os.ReadFile(path)
+	cfg, problems, err := load(path)
 	if err != nil {
 		return nil, err
 	}
+	if len(problems) > 0 {
+		return nil, &ValidationError{Problems: problems}
+	}
+	return cfg, nil
+}
+
+// Check loads path and reports every problem in it at once as a
+// *ValidationError: unset variables, unknown keys, values of the wrong
+// type and everything Validate finds. Other errors mean the file could not
+// be read or parsed at all.
+func Check(path string) error {
+	cfg, problems, err := load(path)
+	if err != nil {
+		return err
+	}
+	var verr *ValidationError
+	if err := cfg.Validate(); errors.As(err, &verr) {
+		problems = append(problems, verr.Problems...)
+	} else if err != nil {
+		problems = append(problems, err.Error())
+	}
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// load is Load without giving up at the first bad field; problems that
+// only affect single fields are returned next to the config.
+func load(path string) (*Config, []string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	data, err = expandEnvRefs(data, add)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	var cfg Config
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
-		return nil, err
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		var terr *yaml.TypeError
+		if !errors.As(err, &terr) {
+			return nil, nil, err
+		}
+		for _, e := range terr.Errors {
+			add("%s", e)
+		}
 	}
+	applyEnvOverrides(&cfg, add)
 
 	if cfg.DockerBin == "" {
 		cfg.DockerBin = "docker"
@@ -54,6 +239,286 @@ func Load(path string) (*Config, error) {
 	if cfg.FileRoot == "" {
 		cfg.FileRoot = "/"
 	}
+	if cfg.Maintenance.FlagFile == "" {
+		cfg.Maintenance.FlagFile = "maintenance.flag"
+	}
+	if cfg.Audit.Path == "" {
+		cfg.Audit.Path = "audit.jsonl"
+	}
+	if cfg.Audit.MaxSizeMB <= 0 {
+		cfg.Audit.MaxSizeMB = 50
+	}
+	if cfg.Audit.MaxFiles <= 0 {
+		cfg.Audit.MaxFiles = 5
+	}
+	cfg.mergeLegacyMaps()
+
+	return &cfg, problems, nil
+}
+
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return strings.Join(e.Problems, "; ")
+}
 
-	return &cfg, nil
+// Validate checks the whole config and reports every problem at once as a
+// *ValidationError.
+func (c *Config) Validate() error {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.AgentID == "" {
+		add("agentId is required")
+	}
+	if c.Token == "" {
+		add("token is required")
+	}
+	if c.WSURL == "" {
+		add("wsUrl is required")
+	} else if u, err := url.Parse(c.WSURL); err != nil {
+		add("wsUrl %q is not a valid URL: %v", c.WSURL, err)
+	} else if u.Scheme != "ws" && u.Scheme != "wss" {
+		add("wsUrl %q must use ws:// or wss://", c.WSURL)
+	} else if u.Host == "" {
+		add("wsUrl %q has no host", c.WSURL)
+	}
+	if info, err := os.Stat(c.FileRoot); err != nil {
+		add("fileRoot %q does not exist", c.FileRoot)
+	} else if !info.IsDir() {
+		add("fileRoot %q is not a directory", c.FileRoot)
+	}
+	validateRcon("rcon", c.Rcon, add)
+	validateActions("security.allowActions", c.Security.AllowActions, add)
+	validateCommandRules("security.commandRules", c.Security.CommandRules, add)
+	validateCommandRules("security.execRules", c.Security.ExecRules, add)
+	validateProtect("security.protect", c.Security.Protect, add)
+	if c.Transfers.IdleTimeoutSec < 0 {
+		add("transfers.idleTimeoutSec: must not be negative")
+	}
+	if c.Transfers.MaxUploadsPerServer < 0 {
+		add("transfers.maxUploadsPerServer: must not be negative")
+	}
+	if c.Transfers.MaxDownloadsPerServer < 0 {
+		add("transfers.maxDownloadsPerServer: must not be negative")
+	}
+	if c.Transfers.MaxChunkSize < 0 {
+		add("transfers.maxChunkSize: must not be negative")
+	}
+	for _, pattern := range c.Fetch.AllowHosts {
+		if _, err := path.Match(pattern, ""); err != nil {
+			add("fetch.allowHosts: bad pattern %q", pattern)
+		}
+	}
+	if c.Fetch.MaxBytes < 0 || c.Fetch.MaxRedirects < 0 || c.Fetch.TimeoutSec < 0 {
+		add("fetch: limits must not be negative")
+	}
+
+	switch c.Policy.Default {
+	case "", "allow", "deny":
+	default:
+		add("policy.default: %q must be allow or deny", c.Policy.Default)
+	}
+	for i, r := range c.Policy.Rules {
+		where := fmt.Sprintf("policy.rules[%d]", i)
+		if r.Effect != "allow" && r.Effect != "deny" {
+			add("%s.effect: %q must be allow or deny", where, r.Effect)
+		}
+		for _, pattern := range r.Servers {
+			if _, err := path.Match(pattern, ""); err != nil {
+				add("%s.servers: bad pattern %q", where, pattern)
+			}
+		}
+		for _, a := range r.Actions {
+			if a != "*" && !protocol.IsAction(a) {
+				add("%s.actions: unknown action %q", where, a)
+			}
+		}
+	}
+
+	names := map[string]bool{}
+	for i, t := range c.Tokens {
+		where := fmt.Sprintf("tokens[%d]", i)
+		if t.Name == "" {
+			add("%s: name is required", where)
+		} else {
+			where = fmt.Sprintf("tokens[%d] (%s)", i, t.Name)
+			if names[t.Name] {
+				add("%s: duplicate name", where)
+			}
+			names[t.Name] = true
+		}
+		if t.Token == "" {
+			add("%s: token is required", where)
+		}
+		validateActions(where+".actions", t.Actions, add)
+		for _, pattern := range t.Servers {
+			if _, err := path.Match(pattern, ""); err != nil {
+				add("%s.servers: bad pattern %q", where, pattern)
+			}
+		}
+	}
+
+	seen := map[string]bool{}
+	for i, s := range c.Servers {
+		where := fmt.Sprintf("servers[%d]", i)
+		if s.ID == "" {
+			add("%s: id is required", where)
+		} else {
+			where = fmt.Sprintf("servers[%d] (%s)", i, s.ID)
+			if seen[s.ID] {
+				add("%s: duplicate id", where)
+			}
+			seen[s.ID] = true
+		}
+		if s.Rcon != nil {
+			validateRcon(where+".rcon", *s.Rcon, add)
+		}
+		switch s.ConsoleInput {
+		case "", ConsoleInputAuto, ConsoleInputRcon, ConsoleInputExec:
+		default:
+			add("%s.consoleInput: %q must be one of auto, rcon, exec", where, s.ConsoleInput)
+		}
+		validateActions(where+".allowActions", s.AllowActions, add)
+		validateCommandRules(where+".commandRules", s.CommandRules, add)
+		validateCommandRules(where+".execRules", s.ExecRules, add)
+		validateProtect(where+".protect", s.Protect, add)
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+func validateRcon(where string, rc RconConfig, add func(string, ...interface{})) {
+	if !rc.Enabled {
+		return
+	}
+	if rc.Host == "" {
+		add("%s.host is required when rcon is enabled", where)
+	}
+	if rc.Port < 1 || rc.Port > 65535 {
+		add("%s.port %d is out of range 1-65535", where, rc.Port)
+	}
+}
+
+func validateCommandRules(where string, rules []CommandRule, add func(string, ...interface{})) {
+	for i, r := range rules {
+		if r.Effect != "allow" && r.Effect != "deny" {
+			add("%s[%d].effect: %q must be allow or deny", where, i, r.Effect)
+		}
+		if r.Command == "" || strings.ContainsAny(r.Command, " \t") {
+			add("%s[%d].command: %q must be a single command name or *", where, i, r.Command)
+		}
+		if _, err := regexp.Compile(r.Args); err != nil {
+			add("%s[%d].args: %v", where, i, err)
+		}
+	}
+}
+
+func validateProtect(where string, p ProtectConfig, add func(string, ...interface{})) {
+	for name, patterns := range map[string][]string{"readDeny": p.ReadDeny, "writeDeny": p.WriteDeny, "deleteDeny": p.DeleteDeny} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(strings.Trim(pattern, "/"), ""); err != nil {
+				add("%s.%s: bad pattern %q", where, name, pattern)
+			}
+		}
+	}
+}
+
+func validateActions(where string, actions []string, add func(string, ...interface{})) {
+	for _, a := range actions {
+		if !protocol.IsAction(a) {
+			add("%s: unknown action %q", where, a)
+		}
+	}
+}
+
+// SameConnection reports whether other would connect and authenticate
+// exactly like c, so a reload can keep the current session.
+func (c *Config) SameConnection(other *Config) bool {
+	return c.AgentID == other.AgentID && c.Token == other.Token && c.WSURL == other.WSURL
+}
+
+// HasServer reports whether serverId may be addressed. Once any server block
+// is configured only listed ids are; without blocks every id is allowed and
+// ids missing from containerMap/volumeMap are resolved by container label.
+func (c *Config) HasServer(serverId string) bool {
+	restricted := false
+	for _, s := range c.Servers {
+		if s.ID == serverId {
+			return true
+		}
+		restricted = restricted || !s.legacy
+	}
+	return !restricted
+}
+
+// Server returns the effective settings for serverId, with global rcon and
+// security values filled in where the server block leaves them unset.
+// Unknown ids get the global defaults so label lookup still works.
+func (c *Config) Server(serverId string) ServerConfig {
+	srv := ServerConfig{ID: serverId}
+	for _, s := range c.Servers {
+		if s.ID == serverId {
+			srv = s
+			break
+		}
+	}
+	if srv.Label == "" {
+		srv.Label = srv.ID
+	}
+	if srv.Rcon == nil {
+		rc := c.Rcon
+		srv.Rcon = &rc
+	}
+	if srv.ConsoleInput == "" {
+		srv.ConsoleInput = ConsoleInputAuto
+	}
+	if srv.CommandAllowlist == nil {
+		srv.CommandAllowlist = c.Security.CommandAllowlist
+	}
+	global := c.Security.Protect
+	srv.Protect = ProtectConfig{
+		ReadDeny:   append(append([]string{}, global.ReadDeny...), srv.Protect.ReadDeny...),
+		WriteDeny:  append(append([]string{}, global.WriteDeny...), srv.Protect.WriteDeny...),
+		DeleteDeny: append(append([]string{}, global.DeleteDeny...), srv.Protect.DeleteDeny...),
+	}
+	return srv
+}
+
+func (c *Config) mergeLegacyMaps() {
+	known := map[string]int{}
+	for i, s := range c.Servers {
+		known[s.ID] = i
+	}
+	ids := make([]string, 0, len(c.ContainerMap)+len(c.VolumeMap))
+	for id := range c.ContainerMap {
+		ids = append(ids, id)
+	}
+	for id := range c.VolumeMap {
+		if _, ok := c.ContainerMap[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		i, ok := known[id]
+		if !ok {
+			c.Servers = append(c.Servers, ServerConfig{ID: id, legacy: true})
+			i = len(c.Servers) - 1
+			known[id] = i
+		}
+		if c.Servers[i].Container == "" {
+			c.Servers[i].Container = c.ContainerMap[id]
+		}
+		if c.Servers[i].Volume == "" {
+			c.Servers[i].Volume = c.VolumeMap[id]
+		}
+	}
 }
@@ -0,0 +1,31 @@
+package config
+
+import "testing"
+
+func TestHasServer(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		want map[string]bool
+	}{
+		{"no servers", "", map[string]bool{"lobby": true, "other": true}},
+		{"legacy maps only", "containerMap:\n  lobby: mc-lobby\nvolumeMap:\n  survival: vol-1\n",
+			map[string]bool{"lobby": true, "survival": true, "other": true}},
+		{"server blocks", "servers:\n  - id: lobby\n", map[string]bool{"lobby": true, "other": false}},
+		{"server blocks and legacy maps", "servers:\n  - id: lobby\nvolumeMap:\n  survival: vol-1\n",
+			map[string]bool{"lobby": true, "survival": true, "other": false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := Load(writeFile(t, "config.yaml", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for id, want := range tt.want {
+				if got := cfg.HasServer(id); got != want {
+					t.Errorf("HasServer(%q) = %v, want %v", id, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+const envPrefix = "MINEBOT_AGENT_"
+
+var envRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// lookupEnv returns the value of name, or the contents of the file named by
+// name_FILE when name itself is unset (the Docker/Kubernetes secrets
+// convention). A trailing newline in the file is dropped.
+func lookupEnv(name string) (string, bool, error) {
+	if v, ok := os.LookupEnv(name); ok {
+		return v, true, nil
+	}
+	if p, ok := os.LookupEnv(name + "_FILE"); ok {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return "", false, fmt.Errorf("%s_FILE: %w", name, err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), true, nil
+	}
+	return "", false, nil
+}
+
+// expandEnvRefs replaces ${NAME} in scalar values of the YAML document.
+// Expansion happens on parsed nodes rather than raw text so that values
+// containing YAML syntax cannot change the document structure. Unset
+// variables are reported through add and expand to "".
+func expandEnvRefs(data []byte, add func(string, ...interface{})) ([]byte, error) {
+	if !envRef.Match(data) {
+		return data, nil
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	var walk func(n *yaml.Node)
+	walk = func(n *yaml.Node) {
+		if n.Kind == yaml.ScalarNode && envRef.MatchString(n.Value) {
+			n.Value = envRef.ReplaceAllStringFunc(n.Value, func(ref string) string {
+				name := envRef.FindStringSubmatch(ref)[1]
+				v, ok, err := lookupEnv(name)
+				if err != nil {
+					add("line %d: %v", n.Line, err)
+				} else if !ok {
+					add("line %d: environment variable %s is not set", n.Line, name)
+				}
+				return v
+			})
+			if n.Style == 0 {
+				// let plain scalars re-resolve so ${PORT} can become an int
+				n.Tag = ""
+			}
+		}
+		for _, c := range n.Content {
+			walk(c)
+		}
+	}
+	walk(&root)
+	return yaml.Marshal(&root)
+}
+
+// applyEnvOverrides sets every config field from MINEBOT_AGENT_<PATH> or
+// MINEBOT_AGENT_<PATH>_FILE, where PATH is the yaml key path in upper snake
+// case (rcon.password -> RCON_PASSWORD). Lists of strings are comma
+// separated; maps and the servers list take a YAML or JSON document.
+func applyEnvOverrides(cfg *Config, add func(string, ...interface{})) {
+	overrideStruct(reflect.ValueOf(cfg).Elem(), envPrefix, add)
+}
+
+func overrideStruct(v reflect.Value, prefix string, add func(string, ...interface{})) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := prefix + envName(tag)
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			overrideStruct(field, name+"_", add)
+			continue
+		}
+		raw, ok, err := lookupEnv(name)
+		if err != nil {
+			add("%v", err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if err := setField(field, raw); err != nil {
+			add("%s: %v", name, err)
+		}
+	}
+}
+
+func setField(field reflect.Value, raw string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case reflect.Slice:
+		if field.Type().Elem().Kind() == reflect.String {
+			var list []string
+			for _, item := range strings.Split(raw, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			field.Set(reflect.ValueOf(list))
+			return nil
+		}
+		return decodeInto(field, raw)
+	default:
+		return decodeInto(field, raw)
+	}
+	return nil
+}
+
+// decodeInto parses raw as YAML (or JSON) into field, as strictly as the
+// config file itself is decoded.
+func decodeInto(field reflect.Value, raw string) error {
+	ptr := reflect.New(field.Type())
+	dec := yaml.NewDecoder(strings.NewReader(raw))
+	dec.KnownFields(true)
+	if err := dec.Decode(ptr.Interface()); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	field.Set(ptr.Elem())
+	return nil
+}
+
+// envName turns a yaml key into upper snake case. A run of capitals is one
+// word: maxSizeMB -> MAX_SIZE_MB, wsUrl -> WS_URL.
+func envName(key string) string {
+	runes := []rune(key)
+	var b strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if !unicode.IsUpper(prev) || nextLower {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
@@ -0,0 +1,148 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(p, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// TestLoadPrecedence documents the order in which a value is picked, highest
+// first: MINEBOT_AGENT_X, MINEBOT_AGENT_X_FILE, the file value with ${NAME}
+// (then NAME_FILE) resolved, built-in defaults.
+func TestLoadPrecedence(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		// files maps an env var to the content of the file it points at.
+		files     map[string]string
+		wantToken string
+		wantBin   string
+	}{
+		{
+			name:      "override beats everything",
+			file:      "token: ${TOK}\n",
+			env:       map[string]string{"MINEBOT_AGENT_TOKEN": "env", "TOK": "ref"},
+			files:     map[string]string{"MINEBOT_AGENT_TOKEN_FILE": "override-file\n"},
+			wantToken: "env",
+			wantBin:   "docker",
+		},
+		{
+			name:      "override file beats file value",
+			file:      "token: ${TOK}\n",
+			env:       map[string]string{"TOK": "ref"},
+			files:     map[string]string{"MINEBOT_AGENT_TOKEN_FILE": "override-file\n"},
+			wantToken: "override-file",
+			wantBin:   "docker",
+		},
+		{
+			name:      "reference beats reference file",
+			file:      "token: ${TOK}\n",
+			env:       map[string]string{"TOK": "ref"},
+			files:     map[string]string{"TOK_FILE": "ref-file\n"},
+			wantToken: "ref",
+			wantBin:   "docker",
+		},
+		{
+			name:      "reference file",
+			file:      "token: ${TOK}\n",
+			files:     map[string]string{"TOK_FILE": "ref-file\n"},
+			wantToken: "ref-file",
+			wantBin:   "docker",
+		},
+		{
+			name:      "plain file value beats default",
+			file:      "token: literal\ndockerBin: podman\n",
+			wantToken: "literal",
+			wantBin:   "podman",
+		},
+		{
+			name:      "override beats default",
+			file:      "token: literal\n",
+			env:       map[string]string{"MINEBOT_AGENT_DOCKER_BIN": "nerdctl"},
+			wantToken: "literal",
+			wantBin:   "nerdctl",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			for k, v := range tt.files {
+				t.Setenv(k, writeFile(t, "secret", v))
+			}
+			cfg, err := Load(writeFile(t, "config.yaml", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Token != tt.wantToken {
+				t.Errorf("token = %q, want %q", cfg.Token, tt.wantToken)
+			}
+			if cfg.DockerBin != tt.wantBin {
+				t.Errorf("dockerBin = %q, want %q", cfg.DockerBin, tt.wantBin)
+			}
+		})
+	}
+}
+
+func TestLoadUnsetReference(t *testing.T) {
+	_, err := Load(writeFile(t, "config.yaml", "token: ${MINEBOT_TEST_UNSET}\n"))
+	if err == nil || !strings.Contains(err.Error(), "MINEBOT_TEST_UNSET is not set") {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestLoadNestedOverride(t *testing.T) {
+	t.Setenv("MINEBOT_AGENT_AUDIT_MAX_SIZE_MB", "7")
+	t.Setenv("MINEBOT_AGENT_SECURITY_ALLOW_ACTIONS", "STATS, LIST")
+	t.Setenv("MINEBOT_AGENT_SERVERS", `[{"id": "lobby", "volume": "lobby"}]`)
+	cfg, err := Load(writeFile(t, "config.yaml", "audit:\n  maxSizeMB: 20\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Audit.MaxSizeMB != 7 {
+		t.Errorf("audit.maxSizeMB = %d, want 7", cfg.Audit.MaxSizeMB)
+	}
+	if got := strings.Join(cfg.Security.AllowActions, ","); got != "STATS,LIST" {
+		t.Errorf("security.allowActions = %q", got)
+	}
+	if len(cfg.Servers) != 1 || cfg.Servers[0].Volume != "lobby" {
+		t.Errorf("servers = %+v", cfg.Servers)
+	}
+}
+
+func TestLoadOverrideUnknownKey(t *testing.T) {
+	t.Setenv("MINEBOT_AGENT_SERVERS", `[{"id": "lobby", "volumne": "lobby"}]`)
+	_, err := Load(writeFile(t, "config.yaml", ""))
+	if err == nil || !strings.Contains(err.Error(), "MINEBOT_AGENT_SERVERS") {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	tests := map[string]string{
+		"token":        "TOKEN",
+		"wsUrl":        "WS_URL",
+		"agentId":      "AGENT_ID",
+		"maxSizeMB":    "MAX_SIZE_MB",
+		"allowActions": "ALLOW_ACTIONS",
+		"HTTPProxy":    "HTTP_PROXY",
+		"sha256Sum":    "SHA256_SUM",
+	}
+	for key, want := range tests {
+		if got := envName(key); got != want {
+			t.Errorf("envName(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package config
+
+import (
+	"crypto/sha256"
+	"os"
+	"time"
+)
+
+// Watch polls path every interval and sends on the returned channel whenever
+// the file content changes. Polling avoids platform-specific notify APIs and
+// survives editors that replace the file instead of writing in place.
+func Watch(path string, interval time.Duration) <-chan struct{} {
+	ch := make(chan struct{}, 1)
+	go func() {
+		last := fileDigest(path)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			cur := fileDigest(path)
+			if cur == nil || string(cur) == string(last) {
+				continue
+			}
+			last = cur
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return ch
+}
+
+func fileDigest(path string) []byte {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
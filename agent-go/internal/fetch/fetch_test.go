@@ -0,0 +1,160 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const body = "plugin jar contents"
+
+// newServer serves body at /file (with a Content-Length) and /stream
+// (chunked, so the size is only known while reading). /redirect/N takes N
+// redirects to reach /file, and /away redirects to the same server under
+// the name "localhost".
+func newServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/java-archive")
+		fmt.Fprint(w, body)
+	})
+	mux.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 4; i++ {
+			fmt.Fprint(w, body)
+			w.(http.Flusher).Flush()
+		}
+	})
+	mux.HandleFunc("/redirect/", func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/redirect/"))
+		if err != nil || n <= 1 {
+			http.Redirect(w, r, "/file", http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, "/redirect/"+strconv.Itoa(n-1), http.StatusFound)
+	})
+	srv := httptest.NewServer(mux)
+	mux.HandleFunc("/away", func(w http.ResponseWriter, r *http.Request) {
+		u, _ := url.Parse(srv.URL)
+		http.Redirect(w, r, "http://localhost:"+u.Port()+"/file", http.StatusFound)
+	})
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func digests() (string, string) {
+	s256, s1 := sha256.Sum256([]byte(body)), sha1.Sum([]byte(body))
+	return hex.EncodeToString(s256[:]), hex.EncodeToString(s1[:])
+}
+
+func TestFetch(t *testing.T) {
+	srv := newServer(t)
+	sum256, sum1 := digests()
+
+	var buf bytes.Buffer
+	res, err := Fetch(context.Background(), Options{
+		URL:          srv.URL + "/redirect/2",
+		AllowHosts:   []string{"127.0.0.1"},
+		MaxBytes:     int64(len(body)),
+		MaxRedirects: 2,
+		SHA256:       strings.ToUpper(sum256),
+		SHA1:         sum1,
+	}, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != body {
+		t.Errorf("wrote %q, want %q", buf.String(), body)
+	}
+	if res.Bytes != int64(len(body)) || res.SHA256 != sum256 || res.SHA1 != sum1 {
+		t.Errorf("result %+v", res)
+	}
+	if res.URL != srv.URL+"/file" {
+		t.Errorf("final URL %s, want %s/file", res.URL, srv.URL)
+	}
+	if res.ContentType != "application/java-archive" {
+		t.Errorf("content type %q", res.ContentType)
+	}
+}
+
+func TestFetchRefused(t *testing.T) {
+	srv := newServer(t)
+	sum256, sum1 := digests()
+
+	tests := []struct {
+		name string
+		opts Options
+		want string
+	}{
+		{"host not allowed", Options{URL: srv.URL + "/file", AllowHosts: []string{"cdn.modrinth.com"}}, "not in fetch.allowHosts"},
+		{"empty allow list", Options{URL: srv.URL + "/file"}, "not in fetch.allowHosts"},
+		{"scheme", Options{URL: "file:///etc/passwd", AllowHosts: []string{"*"}}, "unsupported URL scheme"},
+		{"redirect to host not allowed", Options{URL: srv.URL + "/away", AllowHosts: []string{"127.0.0.1"}, MaxRedirects: 5}, "host localhost is not in fetch.allowHosts"},
+		{"too many redirects", Options{URL: srv.URL + "/redirect/3", AllowHosts: []string{"127.0.0.1"}, MaxRedirects: 2}, "more than 2 redirects"},
+		{"redirects disabled", Options{URL: srv.URL + "/redirect/1", AllowHosts: []string{"127.0.0.1"}}, "more than 0 redirects"},
+		{"content length over limit", Options{URL: srv.URL + "/file", AllowHosts: []string{"127.0.0.1"}, MaxBytes: int64(len(body)) - 1}, "limit is"},
+		{"streamed body over limit", Options{URL: srv.URL + "/stream", AllowHosts: []string{"127.0.0.1"}, MaxBytes: int64(len(body)) * 2}, "exceeds limit"},
+		{"not found", Options{URL: srv.URL + "/missing", AllowHosts: []string{"127.0.0.1"}}, "HTTP 404"},
+		{"sha256 mismatch", Options{URL: srv.URL + "/file", AllowHosts: []string{"127.0.0.1"}, SHA256: strings.Repeat("0", 64), SHA1: sum1}, "sha256 mismatch"},
+		{"sha1 mismatch", Options{URL: srv.URL + "/file", AllowHosts: []string{"127.0.0.1"}, SHA256: sum256, SHA1: strings.Repeat("0", 40)}, "sha1 mismatch"},
+		{"sha256 not hex", Options{URL: srv.URL + "/file", AllowHosts: []string{"127.0.0.1"}, SHA256: strings.Repeat("z", 64)}, "sha256 must be 64 hex characters"},
+		{"sha256 truncated", Options{URL: srv.URL + "/file", AllowHosts: []string{"127.0.0.1"}, SHA256: sum256[:10]}, "sha256 must be 64 hex characters"},
+		{"sha1 given as sha256", Options{URL: srv.URL + "/file", AllowHosts: []string{"127.0.0.1"}, SHA1: sum256}, "sha1 must be 40 hex characters"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := Fetch(context.Background(), tt.opts, &bytes.Buffer{})
+			if err == nil {
+				t.Fatalf("expected an error, got %+v", res)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error %q does not mention %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// Malformed digests are refused before any request is made.
+func TestFetchChecksDigestsFirst(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprint(w, body)
+	}))
+	defer srv.Close()
+
+	_, err := Fetch(context.Background(), Options{URL: srv.URL, AllowHosts: []string{"127.0.0.1"}, SHA1: "abc"}, &bytes.Buffer{})
+	if err == nil || requests != 0 {
+		t.Errorf("err %v after %d requests", err, requests)
+	}
+}
+
+func TestHostAllowed(t *testing.T) {
+	tests := []struct {
+		host     string
+		patterns []string
+		want     bool
+	}{
+		{"cdn.modrinth.com", []string{"cdn.modrinth.com"}, true},
+		{"CDN.Modrinth.com.", []string{"cdn.modrinth.com"}, true},
+		{"api.papermc.io", []string{"*.papermc.io"}, true},
+		{"papermc.io", []string{"*.papermc.io"}, false},
+		{"evil.com", []string{"*.papermc.io", "cdn.modrinth.com"}, false},
+		{"cdn.modrinth.com.evil.com", []string{"cdn.modrinth.com"}, false},
+		{"anything", nil, false},
+	}
+	for _, tt := range tests {
+		if got := HostAllowed(tt.host, tt.patterns); got != tt.want {
+			t.Errorf("HostAllowed(%q, %q) = %v, want %v", tt.host, tt.patterns, got, tt.want)
+		}
+	}
+}
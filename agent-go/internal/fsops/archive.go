@@ -0,0 +1,485 @@
+package fsops
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+const (
+	FormatZip    = "zip"
+	FormatTarGz  = "tar.gz"
+	FormatTarZst = "tar.zst"
+)
+
+const (
+	kindZip = "zip"
+	kindTar = "tar"
+	// kindRaw is a single compressed file such as world.dat.gz.
+	kindRaw = "raw"
+)
+
+type archiveFormat struct {
+	kind        string
+	compression string
+}
+
+var compressionMagic = []struct {
+	name  string
+	magic []byte
+}{
+	{"gzip", []byte{0x1f, 0x8b}},
+	{"zstd", []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{"xz", []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{"bzip2", []byte("BZh")},
+}
+
+var compressionExt = map[string][]string{
+	"gzip":  {".tgz", ".gz"},
+	"zstd":  {".tzst", ".zst"},
+	"xz":    {".txz", ".xz"},
+	"bzip2": {".tbz2", ".tbz", ".bz2"},
+}
+
+// detectFormat identifies an archive by its leading bytes rather than its
+// name. Compressed streams are peeked into to tell tarballs from single
+// compressed files.
+func detectFormat(abs string) (archiveFormat, error) {
+	f, err := os.Open(abs)
+	if err != nil {
+		return archiveFormat{}, err
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	head = head[:n]
+
+	if bytes.HasPrefix(head, []byte("PK\x03\x04")) || bytes.HasPrefix(head, []byte("PK\x05\x06")) {
+		return archiveFormat{kind: kindZip}, nil
+	}
+	if isTarHeader(head) {
+		return archiveFormat{kind: kindTar}, nil
+	}
+	for _, c := range compressionMagic {
+		if !bytes.HasPrefix(head, c.magic) {
+			continue
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return archiveFormat{}, err
+		}
+		r, err := decompressor(f, c.name)
+		if err != nil {
+			return archiveFormat{}, err
+		}
+		inner := make([]byte, 512)
+		n, _ := io.ReadFull(r, inner)
+		r.Close()
+		if isTarHeader(inner[:n]) {
+			return archiveFormat{kind: kindTar, compression: c.name}, nil
+		}
+		return archiveFormat{kind: kindRaw, compression: c.name}, nil
+	}
+	return archiveFormat{}, errors.New("unsupported archive type")
+}
+
+func isTarHeader(b []byte) bool {
+	return len(b) >= 262 && bytes.Equal(b[257:262], []byte("ustar"))
+}
+
+func decompressor(r io.Reader, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case "":
+		return io.NopCloser(r), nil
+	case "gzip":
+		return gzip.NewReader(r)
+	case "zstd":
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case "xz":
+		x, err := xz.NewReader(bufio.NewReader(r))
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(x), nil
+	case "bzip2":
+		return io.NopCloser(bzip2.NewReader(r)), nil
+	}
+	return nil, fmt.Errorf("unsupported compression %q", compression)
+}
+
+// openStream opens abs and returns its decompressed content.
+func openStream(abs, compression string) (io.ReadCloser, error) {
+	f, err := os.Open(abs)
+	if err != nil {
+		return nil, err
+	}
+	r, err := decompressor(bufio.NewReader(f), compression)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &stackedCloser{Reader: r, closers: []io.Closer{r, f}}, nil
+}
+
+type stackedCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (s *stackedCloser) Close() error {
+	var first error
+	for _, c := range s.closers {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// rawOutputName is the file a single compressed file decompresses to.
+func rawOutputName(name, compression string) string {
+	lower := strings.ToLower(name)
+	for _, ext := range compressionExt[compression] {
+		if strings.HasSuffix(lower, ext) && len(name) > len(ext) {
+			return name[:len(name)-len(ext)]
+		}
+	}
+	return name + ".out"
+}
+
+// archiveName picks the COMPRESS output name: the requested one with the
+// format's extension ensured, or archive-<ts>.<ext>.
+func archiveName(name, format string) (string, error) {
+	if format == "" {
+		format = FormatZip
+	}
+	switch format {
+	case FormatZip, FormatTarGz, FormatTarZst:
+	default:
+		return "", fmt.Errorf("unsupported archive format %q", format)
+	}
+	if name == "" {
+		return fmt.Sprintf("archive-%d.%s", time.Now().Unix(), format), nil
+	}
+	if strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return "", errors.New("archive name must not contain path separators")
+	}
+	if !strings.HasSuffix(strings.ToLower(name), "."+format) {
+		name += "." + format
+	}
+	return name, nil
+}
+
+func writeArchive(archivePath, format string, base Base, root string, files []string) error {
+	out, err := os.Create(archivePath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if err := streamArchive(out, format, archivePath, base, root, files); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+// streamArchive writes files under root as an archive to w, leaving out
+// skip (the archive itself when it is written inside the tree).
+func streamArchive(w io.Writer, format, skip string, base Base, root string, files []string) error {
+	var cw io.WriteCloser
+	switch format {
+	case "", FormatZip:
+		return zipPaths(w, skip, base, root, files)
+	case FormatTarGz:
+		cw = gzip.NewWriter(w)
+	case FormatTarZst:
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			return err
+		}
+		cw = zw
+	default:
+		return fmt.Errorf("unsupported archive format %q", format)
+	}
+	if err := tarPaths(cw, skip, base, root, files); err != nil {
+		cw.Close()
+		return err
+	}
+	return cw.Close()
+}
+
+func tarPaths(w io.Writer, archivePath string, base Base, root string, files []string) error {
+	tw := tar.NewWriter(w)
+	for _, name := range files {
+		abs, err := base.safePath(filepath.Join(root, name))
+		if err != nil {
+			return err
+		}
+		if err := base.checkTree(abs, OpRead); err != nil {
+			return err
+		}
+		err = filepath.Walk(abs, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if p == archivePath {
+				return nil
+			}
+			if info.IsDir() && base.isStaging(p) {
+				return filepath.SkipDir
+			}
+			relPath, _ := filepath.Rel(filepath.Join(base.Dir, root), p)
+			if relPath == "" || relPath == "." {
+				relPath = filepath.Base(p)
+			}
+			link := ""
+			if info.Mode()&os.ModeSymlink != 0 {
+				if err := base.confined(p); err != nil {
+					return err
+				}
+				if link, err = os.Readlink(p); err != nil {
+					return err
+				}
+			} else if !info.IsDir() && !info.Mode().IsRegular() {
+				return nil
+			}
+			hdr, err := tar.FileInfoHeader(info, link)
+			if err != nil {
+				return err
+			}
+			hdr.Name = filepath.ToSlash(relPath)
+			if info.IsDir() {
+				hdr.Name += "/"
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			file, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			_, err = io.Copy(tw, file)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// errStopWalk ends walkArchive early without an error.
+var errStopWalk = errors.New("stop walk")
+
+type ArchiveEntry struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	// CompressedSize is -1 when the archive does not record it per entry
+	// (compressed tarballs, single compressed files).
+	CompressedSize int64  `json:"compressedSize"`
+	Mode           string `json:"mode"`
+	ModifiedAt     string `json:"modifiedAt"`
+	IsDir          bool   `json:"isDir"`
+	IsSymlink      bool   `json:"isSymlink"`
+	Link           string `json:"link,omitempty"`
+}
+
+func newArchiveEntry(name string, size, compressed int64, mode os.FileMode, mtime time.Time) ArchiveEntry {
+	return ArchiveEntry{
+		Path:           name,
+		Size:           size,
+		CompressedSize: compressed,
+		Mode:           fmt.Sprintf("%#o", mode.Perm()),
+		ModifiedAt:     mtime.UTC().Format(time.RFC3339),
+		IsDir:          mode.IsDir(),
+		IsSymlink:      mode&os.ModeSymlink != 0,
+	}
+}
+
+// walkArchive calls fn for every directory, file and link in the archive.
+// open returns the entry's content and is only valid during the call.
+func walkArchive(abs string, format archiveFormat, fn func(e ArchiveEntry, open func() (io.ReadCloser, error)) error) error {
+	var err error
+	switch format.kind {
+	case kindZip:
+		err = walkZip(abs, fn)
+	case kindTar:
+		err = walkTar(abs, format.compression, fn)
+	case kindRaw:
+		err = walkRaw(abs, format.compression, fn)
+	}
+	if err == errStopWalk {
+		return nil
+	}
+	return err
+}
+
+func walkZip(abs string, fn func(ArchiveEntry, func() (io.ReadCloser, error)) error) error {
+	r, err := zip.OpenReader(abs)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		e := newArchiveEntry(f.Name, int64(f.UncompressedSize64), int64(f.CompressedSize64), f.Mode(), f.Modified)
+		if err := fn(e, f.Open); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func walkTar(abs, compression string, fn func(ArchiveEntry, func() (io.ReadCloser, error)) error) error {
+	r, err := openStream(abs, compression)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir, tar.TypeReg, tar.TypeSymlink, tar.TypeLink:
+		default:
+			continue
+		}
+		e := newArchiveEntry(hdr.Name, hdr.Size, -1, hdr.FileInfo().Mode(), hdr.ModTime)
+		if compression == "" {
+			e.CompressedSize = hdr.Size
+		}
+		if hdr.Typeflag == tar.TypeSymlink || hdr.Typeflag == tar.TypeLink {
+			e.Size, e.CompressedSize, e.Link = 0, 0, hdr.Linkname
+		}
+		open := func() (io.ReadCloser, error) { return io.NopCloser(tr), nil }
+		if err := fn(e, open); err != nil {
+			return err
+		}
+	}
+}
+
+func walkRaw(abs, compression string, fn func(ArchiveEntry, func() (io.ReadCloser, error)) error) error {
+	info, err := os.Stat(abs)
+	if err != nil {
+		return err
+	}
+	e := newArchiveEntry(rawOutputName(filepath.Base(abs), compression), -1, info.Size(), info.Mode(), info.ModTime())
+	return fn(e, func() (io.ReadCloser, error) { return openStream(abs, compression) })
+}
+
+func openArchive(base Base, root, file string) (string, archiveFormat, error) {
+	abs, err := base.safePath(filepath.Join(root, file))
+	if err != nil {
+		return "", archiveFormat{}, err
+	}
+	if err := base.checkAccess(abs, OpRead); err != nil {
+		return "", archiveFormat{}, err
+	}
+	format, err := detectFormat(abs)
+	return abs, format, err
+}
+
+type ArchiveListing struct {
+	Entries []ArchiveEntry `json:"entries"`
+	Total   int            `json:"total"`
+}
+
+// ListArchive returns entries offset..offset+limit of an archive and the
+// total entry count.
+func ListArchive(base Base, root, file string, offset, limit int) (*ArchiveListing, error) {
+	abs, format, err := openArchive(base, root, file)
+	if err != nil {
+		return nil, err
+	}
+	out := &ArchiveListing{Entries: []ArchiveEntry{}}
+	err = walkArchive(abs, format, func(e ArchiveEntry, _ func() (io.ReadCloser, error)) error {
+		if out.Total >= offset && len(out.Entries) < limit {
+			out.Entries = append(out.Entries, e)
+		}
+		out.Total++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ReadArchiveEntry returns up to max bytes of one archive entry as text.
+func ReadArchiveEntry(base Base, root, file, entry string, max int64) (content string, truncated bool, err error) {
+	abs, format, err := openArchive(base, root, file)
+	if err != nil {
+		return "", false, err
+	}
+	want := normalizeEntry(entry)
+	found := false
+	err = walkArchive(abs, format, func(e ArchiveEntry, open func() (io.ReadCloser, error)) error {
+		if normalizeEntry(e.Path) != want {
+			return nil
+		}
+		found = true
+		if e.IsDir || e.Link != "" {
+			return fmt.Errorf("archive entry %q is not a regular file", entry)
+		}
+		r, err := open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		data, err := io.ReadAll(io.LimitReader(r, max+1))
+		if err != nil {
+			return err
+		}
+		if int64(len(data)) > max {
+			data, truncated = trimPartialRune(data[:max]), true
+		}
+		if !utf8.Valid(data) {
+			return fmt.Errorf("archive entry %q is not text", entry)
+		}
+		content = string(data)
+		return errStopWalk
+	})
+	if err != nil {
+		return "", false, err
+	}
+	if !found {
+		return "", false, fmt.Errorf("archive has no entry %q", entry)
+	}
+	return content, truncated, nil
+}
+
+// trimPartialRune drops a multi-byte character cut off by truncation.
+func trimPartialRune(b []byte) []byte {
+	for i := 0; i < utf8.UTFMax && len(b) > 0; i++ {
+		if utf8.Valid(b) {
+			return b
+		}
+		b = b[:len(b)-1]
+	}
+	return b
+}
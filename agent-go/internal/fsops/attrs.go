@@ -0,0 +1,58 @@
+package fsops
+
+import (
+	"io/fs"
+	"os"
+	"time"
+)
+
+// attrs is the metadata carried across COPY, COMPRESS and DECOMPRESS.
+// Setuid, setgid and sticky bits are deliberately not restored.
+type attrs struct {
+	mode     os.FileMode
+	mtime    time.Time
+	uid, gid int
+	hasOwner bool
+}
+
+func attrsFromInfo(info fs.FileInfo) attrs {
+	a := attrs{mode: info.Mode().Perm(), mtime: info.ModTime()}
+	a.uid, a.gid, a.hasOwner = fileOwner(info)
+	return a
+}
+
+// apply sets mode, mtime and optionally owner on p. Symlinks only get
+// their owner changed; their mode and times are not portable to set.
+func (a attrs) apply(p string, isLink, preserveOwner bool) error {
+	if preserveOwner && a.hasOwner {
+		if err := os.Lchown(p, a.uid, a.gid); err != nil {
+			return err
+		}
+	}
+	if isLink {
+		return nil
+	}
+	if err := os.Chmod(p, a.mode); err != nil {
+		return err
+	}
+	if a.mtime.IsZero() {
+		return nil
+	}
+	return os.Chtimes(p, a.mtime, a.mtime)
+}
+
+type pendingDir struct {
+	path  string
+	attrs attrs
+}
+
+// finishDirs applies directory attributes deepest first, after all
+// children are written, so read-only modes and mtimes stick.
+func finishDirs(dirs []pendingDir, preserveOwner bool) error {
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := dirs[i].attrs.apply(dirs[i].path, false, preserveOwner); err != nil {
+			return err
+		}
+	}
+	return nil
+}
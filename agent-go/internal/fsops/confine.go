@@ -0,0 +1,236 @@
+package fsops
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const maxLinkHops = 40
+
+var errSymlinkEscape = errors.New("path escapes base through a symlink")
+
+// resolveBeneath maps cleaned (already lexically inside base) to the same
+// location with every symlink in its directories resolved, and follows a
+// symlink in the last element only to verify where it points. Any step
+// that leaves the real base is refused. The result stays expressed under
+// base so callers can keep computing paths relative to it, and a symlink
+// in the last element is returned as the link itself so DELETE and RENAME
+// act on the link rather than its target. With checkFinal false the last
+// element's target is not checked, which is only safe for operations on
+// the link itself.
+func resolveBeneath(base, cleaned string, checkFinal bool) (string, error) {
+	realBase, err := filepath.EvalSymlinks(base)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(base, cleaned)
+	if err != nil {
+		return "", err
+	}
+	if rel == "." {
+		return cleaned, nil
+	}
+	root, parts := splitPath(filepath.Join(realBase, rel))
+	finals, err := resolveInside(realBase, root, parts, 0, checkFinal)
+	if err != nil {
+		return "", err
+	}
+	realRel, err := filepath.Rel(realBase, finals[0])
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(base, realRel), nil
+}
+
+// resolveInside is walk, failing unless every place the last element
+// leads to stays inside realBase.
+func resolveInside(realBase, cur string, parts []string, linkParts int, followFinal bool) ([]string, error) {
+	finals, err := walk(cur, parts, linkParts, followFinal)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range finals {
+		if !isSubPath(realBase, p) {
+			return nil, errSymlinkEscape
+		}
+	}
+	return finals, nil
+}
+
+// walk resolves parts from the real directory cur one element at a time,
+// the way the kernel does: a symlink's target is resolved from the link's
+// real directory before any ".." after it is applied, so "x/.." means the
+// parent of wherever x leads, not the directory x sits in. The first
+// linkParts elements are taken as link text. A symlink in the last element is only
+// followed with followFinal.
+//
+// Elements that do not exist yet are kept as they are, since writes create
+// missing directories, unless ".." still follows in link text, where the
+// outcome would depend on what is created later.
+//
+// walk returns every place the last element was found at: the path itself
+// and, when it is a followed symlink, each hop of its chain.
+func walk(cur string, parts []string, linkParts int, followFinal bool) ([]string, error) {
+	rest := append([]string(nil), parts...)
+	var finals []string
+	links := 0
+	for len(rest) > 0 {
+		name := rest[0]
+		rest = rest[1:]
+		fromLink := linkParts > 0
+		if fromLink {
+			linkParts--
+		}
+		last := len(rest) == 0
+		switch name {
+		case ".":
+			if last {
+				finals = append(finals, cur)
+			}
+			continue
+		case "..":
+			cur = filepath.Dir(cur)
+			if last {
+				finals = append(finals, cur)
+			}
+			continue
+		}
+		next := filepath.Join(cur, name)
+		info, err := os.Lstat(next)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+			if fromLink && containsDotDot(rest[:linkParts]) {
+				return nil, errSymlinkEscape
+			}
+			return append(finals, filepath.Join(append([]string{next}, rest...)...)), nil
+		}
+		if last {
+			finals = append(finals, next)
+		}
+		if info.Mode()&os.ModeSymlink == 0 || (last && !followFinal) {
+			cur = next
+			continue
+		}
+		if links++; links > maxLinkHops {
+			return nil, errors.New("too many levels of symbolic links")
+		}
+		target, err := os.Readlink(next)
+		if err != nil {
+			return nil, err
+		}
+		root, text := splitPath(target)
+		if root != "" {
+			cur = root
+		}
+		rest = append(text, rest...)
+		linkParts += len(text)
+	}
+	if len(finals) == 0 {
+		finals = append(finals, cur)
+	}
+	return finals, nil
+}
+
+// splitPath splits p into its root (the volume and a separator, or "" for
+// a relative path) and its elements, without cleaning it.
+func splitPath(p string) (root string, parts []string) {
+	vol := filepath.VolumeName(p)
+	if filepath.IsAbs(p) {
+		root = vol + string(filepath.Separator)
+	}
+	parts = strings.FieldsFunc(p[len(vol):], func(r rune) bool { return os.IsPathSeparator(uint8(r)) })
+	return root, parts
+}
+
+func containsDotDot(parts []string) bool {
+	for _, part := range parts {
+		if part == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// targets returns abs, as produced by safePath, followed by every hop of
+// the symlink chain its last element starts, all expressed under base.Dir.
+func (base Base) targets(abs string) ([]string, error) {
+	realBase, err := filepath.EvalSymlinks(base.Dir)
+	if err != nil {
+		return nil, err
+	}
+	rel, err := filepath.Rel(base.Dir, abs)
+	if err != nil {
+		return nil, err
+	}
+	root, parts := splitPath(filepath.Join(realBase, rel))
+	finals, err := resolveInside(realBase, root, parts, 0, true)
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{abs}
+	for _, hop := range finals[1:] {
+		rel, err := filepath.Rel(realBase, hop)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, filepath.Join(base.Dir, rel))
+	}
+	return paths, nil
+}
+
+// checkNewLink fails unless a symlink at link (a path under base.Dir)
+// holding text would lead inside the base, resolving text the way the
+// kernel will rather than cleaning it.
+func (base Base) checkNewLink(link, text string) error {
+	realBase, err := filepath.EvalSymlinks(base.Dir)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(base.Dir, filepath.Dir(link))
+	if err != nil {
+		return err
+	}
+	root, parts := splitPath(filepath.Join(realBase, rel))
+	dirs, err := resolveInside(realBase, root, parts, 0, true)
+	if err != nil {
+		return err
+	}
+	cur := dirs[len(dirs)-1]
+	root, parts = splitPath(text)
+	if root != "" {
+		cur = root
+	}
+	_, err = resolveInside(realBase, cur, parts, len(parts), true)
+	return err
+}
+
+// Resolve returns where path ends up once every symlink, including one in
+// the last element, is followed, as a slash-separated path from the base
+// starting with "/". It fails like any file action would when the path or
+// a link leaves the base.
+func (base Base) Resolve(path string) (string, error) {
+	abs, err := base.safePath(path)
+	if err != nil {
+		return "", err
+	}
+	paths, err := base.targets(abs)
+	if err != nil {
+		return "", err
+	}
+	return relPath(base.Dir, paths[len(paths)-1]), nil
+}
+
+// confined reports an error unless abs, found while walking a tree under
+// base, still resolves inside base.
+func (base Base) confined(abs string) error {
+	rel, err := filepath.Rel(base.Dir, abs)
+	if err != nil {
+		return err
+	}
+	_, err = base.safePath(rel)
+	return err
+}
@@ -0,0 +1,330 @@
+package fsops
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+// newTree creates a base directory and a directory outside it, and builds
+// the given links (name under base -> target) inside the base. A target
+// starting with "@" is taken relative to the outside directory.
+func newTree(t *testing.T, links map[string]string) (base, outside string) {
+	t.Helper()
+	base = filepath.Join(t.TempDir(), "base")
+	outside = filepath.Join(t.TempDir(), "outside")
+	for _, dir := range []string{base, outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, filepath.Join(outside, "victim"), "outside")
+	for name, target := range links {
+		if len(target) > 0 && target[0] == '@' {
+			target = filepath.Join(outside, target[1:])
+		}
+		link := filepath.Join(base, name)
+		if err := os.MkdirAll(filepath.Dir(link), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(target, link); err != nil {
+			t.Skipf("symlinks unavailable: %v", err)
+		}
+	}
+	return base, outside
+}
+
+func writeFile(t *testing.T, p, content string) {
+	t.Helper()
+	if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, p string) string {
+	t.Helper()
+	data, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestSymlinkEscape(t *testing.T) {
+	dir, outside := newTree(t, map[string]string{
+		"etc":        "/etc",
+		"passwd":     "/etc/passwd",
+		"out":        "@",
+		"victim":     "@victim",
+		"nested/up":  "../../outside",
+		"chain/a":    "b",
+		"chain/b":    "c",
+		"chain/c":    "@victim",
+		"chain/dir":  "../out",
+		"dangling":   "@missing",
+		"deep/a":     "../chain/a",
+		"loop/a":     "b",
+		"loop/b":     "a",
+		"etcdangled": "/etc/does-not-exist",
+	})
+	base := Base{Dir: dir}
+
+	tests := []struct {
+		name string
+		op   func() error
+	}{
+		{"read through dir link to /etc", func() error { _, err := Read(base, "etc/passwd"); return err }},
+		{"read file link to /etc/passwd", func() error { _, err := Read(base, "passwd"); return err }},
+		{"list dir link to /etc", func() error { _, err := List(base, "etc"); return err }},
+		{"download file link to /etc/passwd", func() error { _, err := NewDownload(base, "passwd", 1024); return err }},
+		{"read through relative link out of base", func() error { _, err := Read(base, "nested/up/victim"); return err }},
+		{"write through dir link", func() error { return Write(base, "out/victim", "x") }},
+		{"write through file link", func() error { return Write(base, "victim", "x") }},
+		{"write through chained links", func() error { return Write(base, "chain/a", "x") }},
+		{"write through chain ending in dir link", func() error { return Write(base, "chain/dir/victim", "x") }},
+		{"write through link to chain", func() error { return Write(base, "deep/a", "x") }},
+		{"write creates through dangling link", func() error { return Write(base, "dangling", "x") }},
+		{"write creates through dangling link to /etc", func() error { return Write(base, "etcdangled", "x") }},
+		{"chmod through file link", func() error { return Chmod(base, "victim", "0777") }},
+		{"mkdir through dir link", func() error { return Mkdir(base, "out", "made") }},
+		{"delete through dir link", func() error { return Delete(base, "out", []string{"victim"}) }},
+		{"rename through dir link", func() error { return Rename(base, "/", "out/victim", "taken") }},
+		{"rename into dir link", func() error { return Rename(base, "/", "chain/c", "out/moved") }},
+		{"copy from file link", func() error { return Copy(base, "victim", false) }},
+		{"upload through dangling link", func() error {
+			_, err := NewStagedFile(base, "dangling", UploadOptions{Overwrite: true})
+			return err
+		}},
+		{"link loop", func() error { _, err := Read(base, "loop/a"); return err }},
+		{"lexical escape", func() error { _, err := Read(base, "../outside/victim"); return err }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.op(); err == nil {
+				t.Fatal("expected the operation to be refused")
+			}
+		})
+	}
+
+	if got := readFile(t, filepath.Join(outside, "victim")); got != "outside" {
+		t.Errorf("outside file changed to %q", got)
+	}
+	if info, err := os.Stat(filepath.Join(outside, "victim")); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("outside file mode changed: %v %v", info.Mode(), err)
+	}
+	for _, name := range []string{"missing", "made"} {
+		if _, err := os.Lstat(filepath.Join(outside, name)); err == nil {
+			t.Errorf("%s was created outside the base", name)
+		}
+	}
+}
+
+// "x/.." in a link target is the parent of wherever x leads, not the
+// directory x sits in, so cleaning the text as a string gets it wrong.
+func TestSymlinkDotDotAfterLink(t *testing.T) {
+	dir, outside := newTree(t, map[string]string{"d1/d2/x": "../.."})
+	up, err := filepath.Rel(filepath.Dir(dir), outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// joined by hand: filepath.Join would clean the ".." away
+	sep := string(filepath.Separator)
+	for name, target := range map[string]string{
+		"d1/d2/l":    "x" + sep + ".." + sep + up + sep + "victim",
+		"d1/d2/ldir": "x" + sep + ".." + sep + up,
+		"d1/d2/lnew": "x" + sep + ".." + sep + up + sep + "missing",
+	} {
+		if err := os.Symlink(target, filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	base := Base{Dir: dir}
+
+	tests := []struct {
+		name string
+		op   func() error
+	}{
+		{"read", func() error { _, err := Read(base, "d1/d2/l"); return err }},
+		{"write", func() error { return Write(base, "d1/d2/l", "x") }},
+		{"read through dir link", func() error { _, err := Read(base, "d1/d2/ldir/victim"); return err }},
+		{"write through dir link", func() error { return Write(base, "d1/d2/ldir/victim", "x") }},
+		{"create through dangling link", func() error { return Write(base, "d1/d2/lnew", "x") }},
+		{"download", func() error { _, err := NewDownload(base, "d1/d2/l", 1024); return err }},
+		{"resolve", func() error { _, err := base.Resolve("d1/d2/l"); return err }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.op(); err == nil {
+				t.Fatal("expected the operation to be refused")
+			}
+		})
+	}
+	if got := readFile(t, filepath.Join(outside, "victim")); got != "outside" {
+		t.Errorf("outside file changed to %q", got)
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "missing")); err == nil {
+		t.Error("file created outside the base")
+	}
+
+	// the same link text is fine when x leads somewhere deeper
+	if err := os.Remove(filepath.Join(dir, "d1", "d2", "x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "d1", "d2", "x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := base.Resolve("d1/d2/ldir"); err != nil || got != path.Join("/d1/d2/x/..", filepath.ToSlash(up)) {
+		t.Errorf("Resolve(d1/d2/ldir) = %q, %v", got, err)
+	}
+}
+
+// Links already in a copy's destination are replaced, not written through.
+func TestCopyOverLinks(t *testing.T) {
+	dir, outside := newTree(t, map[string]string{
+		"dir-copy/x":   "@victim",
+		"dir-copy/sub": "@",
+		"dir/ln":       "x",
+	})
+	writeFile(t, filepath.Join(dir, "dir", "x"), "copied")
+	if err := os.MkdirAll(filepath.Join(dir, "dir", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "dir", "sub", "victim"), "copied")
+	base := Base{Dir: dir}
+
+	if err := Copy(base, "dir", false); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(outside, "victim")); got != "outside" {
+		t.Errorf("outside file changed to %q", got)
+	}
+	for _, name := range []string{"x", "sub", "sub/victim"} {
+		info, err := os.Lstat(filepath.Join(dir, "dir-copy", name))
+		if err != nil || info.Mode()&os.ModeSymlink != 0 {
+			t.Errorf("dir-copy/%s is not a plain copy: %v", name, err)
+		}
+	}
+	if got, err := Read(base, "dir-copy/ln"); err != nil || got != "copied" {
+		t.Errorf("copied link reads %q, %v", got, err)
+	}
+}
+
+func TestCopyWriteProtected(t *testing.T) {
+	dir, _ := newTree(t, nil)
+	if err := os.MkdirAll(filepath.Join(dir, "certs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "certs", "server.key"), "key")
+	base := Base{Dir: dir, Protect: Protection{WriteDeny: []string{"*.key"}}}
+
+	var perr *ProtectedError
+	if err := Copy(base, "certs", false); !errors.As(err, &perr) {
+		t.Fatalf("got %v, want a ProtectedError", err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "certs-copy", "server.key")); err == nil {
+		t.Error("write-protected file was created by the copy")
+	}
+}
+
+func TestSymlinkInsideBase(t *testing.T) {
+	dir, outside := newTree(t, map[string]string{
+		"cfg":         "config",
+		"chain/a":     "b",
+		"chain/b":     "../config/server.properties",
+		"new":         "config/new.txt",
+		"to-outside":  "@victim",
+		"dir-outside": "@",
+	})
+	if err := os.MkdirAll(filepath.Join(dir, "config"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "config", "server.properties"), "motd=hi")
+	base := Base{Dir: dir}
+
+	if got, err := Read(base, "cfg/server.properties"); err != nil || got != "motd=hi" {
+		t.Errorf("read through dir link: %q, %v", got, err)
+	}
+	if got, err := Read(base, "chain/a"); err != nil || got != "motd=hi" {
+		t.Errorf("read through chained links: %q, %v", got, err)
+	}
+	if err := Write(base, "new", "created"); err != nil {
+		t.Fatalf("write through dangling link inside base: %v", err)
+	}
+	if got := readFile(t, filepath.Join(dir, "config", "new.txt")); got != "created" {
+		t.Errorf("dangling link target has %q", got)
+	}
+	if got, err := base.Resolve("chain/a"); err != nil || got != "/config/server.properties" {
+		t.Errorf("Resolve(chain/a) = %q, %v", got, err)
+	}
+
+	// links leaving the base can still be removed and renamed, since that
+	// only touches the link
+	if err := Rename(base, "/", "to-outside", "renamed"); err != nil {
+		t.Errorf("rename of link leaving base: %v", err)
+	}
+	if err := Delete(base, "/", []string{"renamed", "dir-outside"}); err != nil {
+		t.Errorf("delete of links leaving base: %v", err)
+	}
+	if got := readFile(t, filepath.Join(outside, "victim")); got != "outside" {
+		t.Errorf("outside file changed to %q", got)
+	}
+}
+
+func TestSymlinkToProtected(t *testing.T) {
+	dir, _ := newTree(t, map[string]string{
+		"jar":        "server.jar",
+		"chain/a":    "../jar",
+		"plugins/ln": "../server.jar",
+	})
+	writeFile(t, filepath.Join(dir, "server.jar"), "original")
+	base := Base{Dir: dir, Protect: Protection{
+		ReadDeny:   []string{"server.jar"},
+		WriteDeny:  []string{"server.jar"},
+		DeleteDeny: []string{"server.jar"},
+	}}
+
+	tests := []struct {
+		name string
+		op   func() error
+	}{
+		{"write through link", func() error { return Write(base, "jar", "x") }},
+		{"write through chained links", func() error { return Write(base, "chain/a", "x") }},
+		{"read through link", func() error { _, err := Read(base, "plugins/ln"); return err }},
+		{"chmod through link", func() error { return Chmod(base, "jar", "0600") }},
+		{"download through link", func() error { _, err := NewDownload(base, "jar", 1024); return err }},
+		{"upload through link", func() error {
+			_, err := NewStagedFile(base, "jar", UploadOptions{Overwrite: true})
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var perr *ProtectedError
+			if err := tt.op(); !errors.As(err, &perr) {
+				t.Fatalf("got %v, want a ProtectedError", err)
+			}
+			if perr.Path != "/server.jar" {
+				t.Errorf("protected path %q, want /server.jar", perr.Path)
+			}
+		})
+	}
+	if got := readFile(t, filepath.Join(dir, "server.jar")); got != "original" {
+		t.Errorf("protected file changed to %q", got)
+	}
+
+	// removing or moving the link leaves the protected file alone
+	if err := Rename(base, "/", "jar", "jar2"); err != nil {
+		t.Errorf("rename of link to protected file: %v", err)
+	}
+	if err := Delete(base, "/", []string{"jar2", "chain"}); err != nil {
+		t.Errorf("delete of links to protected file: %v", err)
+	}
+	if err := Delete(base, "/", []string{"server.jar"}); err == nil {
+		t.Error("delete of protected file succeeded")
+	}
+	if got := readFile(t, filepath.Join(dir, "server.jar")); got != "original" {
+		t.Errorf("protected file changed to %q", got)
+	}
+}
@@ -0,0 +1,251 @@
+package fsops
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultChunkSize is used when a download does not ask for a chunk size.
+const DefaultChunkSize = chunkSize
+
+// Download is an open download session: a single file or a directory
+// streamed as an archive.
+type Download interface {
+	Info() DownloadInfo
+	ReadChunk(index int) (DownloadChunk, error)
+	ReadRange(offset int64, length int) (DownloadChunk, error)
+	Abort() error
+}
+
+// DownloadSession serves one file. It only uses ReadAt, so chunks and
+// ranges can be read concurrently, and keeps its own handle, so a file
+// replaced mid-download is still served consistently.
+type DownloadSession struct {
+	file      *os.File
+	info      DownloadInfo
+	chunkSize int
+}
+
+type DownloadInfo struct {
+	// Size and SHA256 are unknown (-1, "") for archive streams.
+	Size       int64  `json:"size"`
+	ModifiedAt string `json:"modifiedAt"`
+	SHA256     string `json:"sha256"`
+	ChunkSize  int    `json:"chunkSize"`
+	Archive    string `json:"archive,omitempty"`
+}
+
+type DownloadChunk struct {
+	Data   []byte
+	Offset int64
+	// Done is set when the chunk reaches the end of the file, so a client
+	// resuming with a new session sees it on the tail it asks for.
+	Done bool
+	// ArchiveSHA256 is the digest of a whole archive stream, set on its
+	// last chunk.
+	ArchiveSHA256 string
+}
+
+// NewDownload opens path and hashes it, reading the whole file once; the
+// caller should not run it where that would hold up other requests.
+func NewDownload(base Base, path string, chunkSize int) (*DownloadSession, error) {
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+	abs, err := base.safePath(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := base.checkAccess(abs, OpRead); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(abs)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		_ = f.Close()
+		return nil, fmt.Errorf("%s is a directory", relPath(base.Dir, abs))
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, info.Size())); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &DownloadSession{
+		file: f,
+		info: DownloadInfo{
+			Size:       info.Size(),
+			ModifiedAt: info.ModTime().UTC().Format(time.RFC3339),
+			SHA256:     hex.EncodeToString(h.Sum(nil)),
+			ChunkSize:  chunkSize,
+		},
+		chunkSize: chunkSize,
+	}, nil
+}
+
+func (s *DownloadSession) Info() DownloadInfo { return s.info }
+
+// ReadChunk returns chunk index of the session's chunk size.
+func (s *DownloadSession) ReadChunk(index int) (DownloadChunk, error) {
+	if index < 0 {
+		return DownloadChunk{}, fmt.Errorf("invalid chunk index %d", index)
+	}
+	return s.ReadRange(int64(index)*int64(s.chunkSize), s.chunkSize)
+}
+
+// ReadRange returns up to length bytes starting at offset.
+func (s *DownloadSession) ReadRange(offset int64, length int) (DownloadChunk, error) {
+	if offset < 0 || length <= 0 {
+		return DownloadChunk{}, fmt.Errorf("invalid range %d+%d", offset, length)
+	}
+	if offset >= s.info.Size {
+		return DownloadChunk{Offset: offset, Done: true}, nil
+	}
+	if remaining := s.info.Size - offset; int64(length) > remaining {
+		length = int(remaining)
+	}
+	buf := make([]byte, length)
+	n, err := s.file.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return DownloadChunk{}, err
+	}
+	return DownloadChunk{Data: buf[:n], Offset: offset, Done: offset+int64(n) >= s.info.Size}, nil
+}
+
+// Abort closes the file; further reads fail.
+func (s *DownloadSession) Abort() error {
+	return s.file.Close()
+}
+
+var errDownloadAborted = errors.New("download aborted")
+
+// ArchiveDownload streams a directory as an archive built on the fly, so
+// nothing is written to disk. The stream has no length or offsets to seek
+// to: chunks must be read in order, and the last one may be asked for
+// again if its reply was lost, even after the stream has finished.
+type ArchiveDownload struct {
+	info DownloadInfo
+	pr   *io.PipeReader
+
+	mu     sync.Mutex
+	next   int
+	offset int64
+	last   *DownloadChunk
+	hash   hash.Hash
+}
+
+func NewArchiveDownload(base Base, path, format string, chunkSize int) (*ArchiveDownload, error) {
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+	if format == "" {
+		format = FormatTarGz
+	}
+	switch format {
+	case FormatZip, FormatTarGz, FormatTarZst:
+	default:
+		return nil, fmt.Errorf("unsupported archive format %q", format)
+	}
+	abs, err := base.safePath(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := base.checkTree(abs, OpRead); err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", relPath(base.Dir, abs))
+	}
+
+	// Archive the directory itself, or the volume's contents at its root.
+	root, files := filepath.Dir(abs), []string{filepath.Base(abs)}
+	if abs == filepath.Clean(base.Dir) {
+		entries, err := os.ReadDir(abs)
+		if err != nil {
+			return nil, err
+		}
+		root, files = abs, nil
+		for _, e := range entries {
+			if e.Name() != stagingDir {
+				files = append(files, e.Name())
+			}
+		}
+	}
+	root, err = filepath.Rel(base.Dir, root)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(streamArchive(pw, format, "", base, root, files))
+	}()
+	return &ArchiveDownload{
+		info: DownloadInfo{
+			Size:       -1,
+			ModifiedAt: info.ModTime().UTC().Format(time.RFC3339),
+			ChunkSize:  chunkSize,
+			Archive:    format,
+		},
+		pr:   pr,
+		hash: sha256.New(),
+	}, nil
+}
+
+func (a *ArchiveDownload) Info() DownloadInfo { return a.info }
+
+func (a *ArchiveDownload) ReadChunk(index int) (DownloadChunk, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.last != nil && index == a.next-1 {
+		return *a.last, nil
+	}
+	if a.last != nil && a.last.Done {
+		return DownloadChunk{}, errors.New("archive stream already finished")
+	}
+	if index != a.next {
+		return DownloadChunk{}, fmt.Errorf("archive downloads must be read in order; next chunk is %d", a.next)
+	}
+	buf := make([]byte, a.info.ChunkSize)
+	n, err := io.ReadFull(a.pr, buf)
+	done := err == io.EOF || err == io.ErrUnexpectedEOF
+	if err != nil && !done {
+		return DownloadChunk{}, err
+	}
+	a.hash.Write(buf[:n])
+	chunk := DownloadChunk{Data: buf[:n], Offset: a.offset, Done: done}
+	if done {
+		chunk.ArchiveSHA256 = hex.EncodeToString(a.hash.Sum(nil))
+	}
+	a.offset += int64(n)
+	a.next++
+	a.last = &chunk
+	return chunk, nil
+}
+
+func (a *ArchiveDownload) ReadRange(offset int64, length int) (DownloadChunk, error) {
+	return DownloadChunk{}, errors.New("byte ranges are not available for archive downloads")
+}
+
+// Abort stops the archive writer and releases the stream.
+func (a *ArchiveDownload) Abort() error {
+	return a.pr.CloseWithError(errDownloadAborted)
+}
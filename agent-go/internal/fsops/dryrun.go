@@ -0,0 +1,188 @@
+package fsops
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+type Plan struct {
+	Create    []string `json:"create"`
+	Overwrite []string `json:"overwrite"`
+	Remove    []string `json:"remove"`
+	Files     int      `json:"files"`
+	Dirs      int      `json:"dirs"`
+	Bytes     int64    `json:"bytes"`
+}
+
+func newPlan() *Plan {
+	return &Plan{Create: []string{}, Overwrite: []string{}, Remove: []string{}}
+}
+
+func (p *Plan) addTarget(base Base, abs string) {
+	rel := relPath(base.Dir, abs)
+	if _, err := os.Lstat(abs); err == nil {
+		p.Overwrite = append(p.Overwrite, rel)
+	} else {
+		p.Create = append(p.Create, rel)
+	}
+}
+
+func PlanDelete(base Base, root string, files []string) (*Plan, error) {
+	plan := newPlan()
+	for _, name := range files {
+		abs, err := base.safeLinkPath(filepath.Join(root, name))
+		if err != nil {
+			return nil, err
+		}
+		if err := base.checkNotBase(abs); err != nil {
+			return nil, err
+		}
+		if _, err := os.Lstat(abs); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		if err := base.checkTree(abs, OpDelete); err != nil {
+			return nil, err
+		}
+		plan.Remove = append(plan.Remove, relPath(base.Dir, abs))
+		err = filepath.WalkDir(abs, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				plan.Dirs++
+				return nil
+			}
+			plan.Files++
+			if info, err := d.Info(); err == nil {
+				plan.Bytes += info.Size()
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return plan, nil
+}
+
+func PlanRename(base Base, root, from, to string) (*Plan, error) {
+	src, err := base.safeLinkPath(filepath.Join(root, from))
+	if err != nil {
+		return nil, err
+	}
+	dst, err := base.safePath(filepath.Join(root, to))
+	if err != nil {
+		return nil, err
+	}
+	for _, abs := range []string{src, dst} {
+		if err := base.checkNotBase(abs); err != nil {
+			return nil, err
+		}
+	}
+	info, err := os.Lstat(src)
+	if err != nil {
+		return nil, err
+	}
+	if err := base.checkTree(src, OpDelete); err != nil {
+		return nil, err
+	}
+	// rename replaces a symlink at dst rather than writing through it
+	if err := base.checkName(dst, OpWrite); err != nil {
+		return nil, err
+	}
+	plan := newPlan()
+	plan.Remove = append(plan.Remove, relPath(base.Dir, src))
+	plan.addTarget(base, dst)
+	if info.IsDir() {
+		plan.Dirs++
+	} else {
+		plan.Files++
+		plan.Bytes = info.Size()
+	}
+	return plan, nil
+}
+
+func PlanDecompress(base Base, root, file, dest string, opts ExtractOptions) (*Plan, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	abs, err := base.safePath(filepath.Join(root, file))
+	if err != nil {
+		return nil, err
+	}
+	if err := base.checkAccess(abs, OpRead); err != nil {
+		return nil, err
+	}
+	destAbs, err := extractDest(base, abs, dest)
+	if err != nil {
+		return nil, err
+	}
+	sel := newSelection(opts.Entries)
+	plan := newPlan()
+	var entryErr error
+	add := func(name string, isDir bool, size int64) {
+		if entryErr != nil || !sel.match(name) {
+			return
+		}
+		target, err := entryTarget(base, destAbs, name)
+		if err == nil && !isDir {
+			target, err = resolveConflict(base, target, opts.Conflict)
+			if err != nil {
+				err = fmt.Errorf("archive entry %q: %v", name, err)
+			}
+		}
+		if err != nil {
+			entryErr = err
+			return
+		}
+		if target == "" {
+			return
+		}
+		if isDir {
+			plan.Dirs++
+		} else {
+			plan.Files++
+			plan.Bytes += size
+		}
+		plan.addTarget(base, target)
+	}
+
+	format, err := detectFormat(abs)
+	if err != nil {
+		return nil, err
+	}
+	err = walkArchive(abs, format, func(e ArchiveEntry, _ func() (io.ReadCloser, error)) error {
+		add(e.Path, e.IsDir, max(e.Size, 0))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if entryErr != nil {
+		return nil, entryErr
+	}
+	if format.kind != kindRaw {
+		if err := sel.missing(); err != nil {
+			return nil, err
+		}
+	}
+	return plan, nil
+}
+
+func relPath(base, abs string) string {
+	rel, err := filepath.Rel(base, abs)
+	if err != nil {
+		return abs
+	}
+	if rel == "." {
+		return "/"
+	}
+	return "/" + filepath.ToSlash(rel)
+}
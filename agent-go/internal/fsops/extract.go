@@ -0,0 +1,426 @@
+package fsops
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Ratio checks only start once this much has been written, so tiny but
+// highly compressible archives are not rejected.
+const ratioGrace = 1 << 20
+
+type ExtractLimits struct {
+	MaxBytes   int64
+	MaxEntries int
+	MaxRatio   float64
+}
+
+var DefaultExtractLimits = ExtractLimits{
+	MaxBytes:   20 << 30,
+	MaxEntries: 200000,
+	MaxRatio:   200,
+}
+
+// Conflict policies for files that already exist at an entry's target.
+const (
+	ConflictOverwrite = "overwrite"
+	ConflictSkip      = "skip"
+	ConflictRename    = "rename"
+	ConflictFail      = "fail"
+)
+
+type ExtractOptions struct {
+	Limits        ExtractLimits
+	PreserveOwner bool
+	// Conflict is one of the Conflict* policies; empty means overwrite.
+	Conflict string
+	// Entries limits extraction to these entries and everything below
+	// them. Empty extracts the whole archive.
+	Entries []string
+}
+
+func (o ExtractOptions) validate() error {
+	switch o.Conflict {
+	case "", ConflictOverwrite, ConflictSkip, ConflictRename, ConflictFail:
+		return nil
+	}
+	return fmt.Errorf("unknown conflict policy %q", o.Conflict)
+}
+
+type extractor struct {
+	base        Base
+	dest        string
+	opts        ExtractOptions
+	sel         *selection
+	archiveSize int64
+	entries     int
+	written     int64
+	created     []string
+	dirs        []pendingDir
+	// moved maps entry targets to the names they were renamed to, so
+	// hard links follow them.
+	moved map[string]string
+}
+
+// selection matches archive entries against ExtractOptions.Entries.
+type selection struct {
+	want    []string
+	matched map[string]bool
+}
+
+func newSelection(entries []string) *selection {
+	s := &selection{matched: map[string]bool{}}
+	for _, e := range entries {
+		if e = normalizeEntry(e); e != "" {
+			s.want = append(s.want, e)
+		}
+	}
+	return s
+}
+
+func normalizeEntry(name string) string {
+	name = strings.Trim(filepath.ToSlash(name), "/")
+	for strings.HasPrefix(name, "./") {
+		name = strings.TrimPrefix(name, "./")
+	}
+	return name
+}
+
+func (s *selection) match(name string) bool {
+	if len(s.want) == 0 {
+		return true
+	}
+	name = normalizeEntry(name)
+	for _, w := range s.want {
+		if name == w || strings.HasPrefix(name, w+"/") {
+			s.matched[w] = true
+			return true
+		}
+	}
+	return false
+}
+
+// missing reports the first selected entry the archive did not contain.
+func (s *selection) missing() error {
+	for _, w := range s.want {
+		if !s.matched[w] {
+			return fmt.Errorf("archive has no entry %q", w)
+		}
+	}
+	return nil
+}
+
+// resolveConflict applies policy to a file entry whose target already
+// exists. It returns the path to write to, or "" to skip the entry.
+func resolveConflict(base Base, target, policy string) (string, error) {
+	if _, err := os.Lstat(target); err != nil {
+		return target, nil
+	}
+	switch policy {
+	case ConflictSkip:
+		return "", nil
+	case ConflictFail:
+		return "", fmt.Errorf("%s already exists", relPath(base.Dir, target))
+	case ConflictRename:
+		return freeName(base, target)
+	}
+	return target, nil
+}
+
+// freeName finds the first "name (n).ext" next to target that does not exist.
+func freeName(base Base, target string) (string, error) {
+	dir, name := filepath.Split(target)
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	for i := 1; i < 10000; i++ {
+		candidate := filepath.Join(dir, fmt.Sprintf("%s (%d)%s", stem, i, ext))
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			if err := base.checkAccess(candidate, OpWrite); err != nil {
+				return "", err
+			}
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("no free name for %s", relPath(base.Dir, target))
+}
+
+// entryTarget validates an archive entry name and maps it to a confined,
+// writable path under dest.
+func entryTarget(base Base, dest, name string) (string, error) {
+	clean := filepath.ToSlash(name)
+	if clean == "" || strings.HasPrefix(clean, "/") || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", fmt.Errorf("archive entry %q: absolute path", name)
+	}
+	for _, part := range strings.Split(clean, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("archive entry %q: path traversal", name)
+		}
+	}
+	rel, err := filepath.Rel(base.Dir, filepath.Join(dest, filepath.FromSlash(clean)))
+	if err != nil {
+		return "", err
+	}
+	target, err := base.safePath(rel)
+	if err != nil {
+		return "", fmt.Errorf("archive entry %q: %v", name, err)
+	}
+	if err := base.checkAccess(target, OpWrite); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// target maps an entry to the path it is extracted to, or "" when the
+// entry is not selected or skipped by the conflict policy.
+func (x *extractor) target(name string, isDir bool) (string, error) {
+	x.entries++
+	if max := x.opts.Limits.MaxEntries; max > 0 && x.entries > max {
+		return "", fmt.Errorf("archive has more than %d entries", max)
+	}
+	if !x.sel.match(name) {
+		return "", nil
+	}
+	target, err := entryTarget(x.base, x.dest, name)
+	if err != nil || isDir {
+		return target, err
+	}
+	resolved, err := resolveConflict(x.base, target, x.opts.Conflict)
+	if err != nil {
+		return "", fmt.Errorf("archive entry %q: %v", name, err)
+	}
+	if resolved != "" && resolved != target {
+		x.moved[target] = resolved
+	}
+	return resolved, nil
+}
+
+func (x *extractor) mkdir(target string, a attrs) error {
+	if _, err := os.Lstat(target); err != nil {
+		x.created = append(x.created, target)
+	}
+	x.dirs = append(x.dirs, pendingDir{path: target, attrs: a})
+	return os.MkdirAll(target, 0755)
+}
+
+func (x *extractor) writeFile(target string, r io.Reader, a attrs) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if info, err := os.Lstat(target); err != nil {
+		x.created = append(x.created, target)
+	} else if info.Mode()&os.ModeSymlink != 0 {
+		// replace the link instead of writing through it
+		if err := os.Remove(target); err != nil {
+			return err
+		}
+	}
+	out, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, &limitedReader{r: r, x: x})
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return a.apply(target, false, x.opts.PreserveOwner)
+}
+
+func (x *extractor) symlink(target, linkname string, a attrs) error {
+	if err := x.createSymlink(target, linkname); err != nil {
+		return err
+	}
+	return a.apply(target, true, x.opts.PreserveOwner)
+}
+
+func (x *extractor) createSymlink(target, linkname string) error {
+	if filepath.IsAbs(linkname) || strings.HasPrefix(filepath.ToSlash(linkname), "/") {
+		return fmt.Errorf("archive symlink %q: absolute target", linkname)
+	}
+	if err := x.base.checkNewLink(target, linkname); err != nil {
+		return fmt.Errorf("archive symlink %q: target outside base", linkname)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if info, err := os.Lstat(target); err == nil {
+		if info.IsDir() {
+			return fmt.Errorf("archive symlink %q: would replace a directory", linkname)
+		}
+		if err := os.Remove(target); err != nil {
+			return err
+		}
+	} else {
+		x.created = append(x.created, target)
+	}
+	return os.Symlink(linkname, target)
+}
+
+func (x *extractor) hardlink(target, linkname string) error {
+	src, err := entryTarget(x.base, x.dest, linkname)
+	if err != nil {
+		return err
+	}
+	if moved, ok := x.moved[src]; ok {
+		src = moved
+	}
+	if err := x.base.checkAccess(src, OpRead); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if _, err := os.Lstat(target); err == nil {
+		if err := os.Remove(target); err != nil {
+			return err
+		}
+	} else {
+		x.created = append(x.created, target)
+	}
+	return os.Link(src, target)
+}
+
+// cleanup removes what a failed extraction created, newest first.
+// Files that existed before and were overwritten are left as they are.
+func (x *extractor) cleanup() {
+	for i := len(x.created) - 1; i >= 0; i-- {
+		_ = os.RemoveAll(x.created[i])
+	}
+}
+
+type limitedReader struct {
+	r io.Reader
+	x *extractor
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.x.written += int64(n)
+	lim := l.x.opts.Limits
+	if lim.MaxBytes > 0 && l.x.written > lim.MaxBytes {
+		return n, fmt.Errorf("archive expands beyond %d bytes", lim.MaxBytes)
+	}
+	if lim.MaxRatio > 0 && l.x.written > ratioGrace && float64(l.x.written) > lim.MaxRatio*float64(l.x.archiveSize) {
+		return n, fmt.Errorf("archive compression ratio exceeds %.0f", lim.MaxRatio)
+	}
+	return n, err
+}
+
+func (x *extractor) unzip(archivePath string) error {
+	r, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		target, err := x.target(f.Name, f.FileInfo().IsDir())
+		if err != nil {
+			return err
+		}
+		if target == "" {
+			continue
+		}
+		a := attrs{mode: f.Mode().Perm(), mtime: f.Modified}
+		if f.FileInfo().IsDir() {
+			if err := x.mkdir(target, a); err != nil {
+				return err
+			}
+			continue
+		}
+		if max := x.opts.Limits.MaxRatio; max > 0 && f.UncompressedSize64 > ratioGrace &&
+			float64(f.UncompressedSize64) > max*float64(f.CompressedSize64) {
+			return fmt.Errorf("archive entry %q: compression ratio exceeds %.0f", f.Name, max)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		if f.Mode()&os.ModeSymlink != 0 {
+			var link []byte
+			link, err = io.ReadAll(io.LimitReader(rc, 4096))
+			if err == nil {
+				err = x.symlink(target, string(link), a)
+			}
+		} else {
+			err = x.writeFile(target, rc, a)
+		}
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *extractor) untar(archivePath, compression string) error {
+	r, err := openStream(archivePath, compression)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return x.untarReader(r)
+}
+
+// unpackRaw decompresses a single compressed file into the destination.
+func (x *extractor) unpackRaw(archivePath, compression string) error {
+	r, err := openStream(archivePath, compression)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	info, err := os.Stat(archivePath)
+	if err != nil {
+		return err
+	}
+	target, err := x.target(rawOutputName(filepath.Base(archivePath), compression), false)
+	if err != nil || target == "" {
+		return err
+	}
+	return x.writeFile(target, r, attrs{mode: info.Mode().Perm(), mtime: info.ModTime()})
+}
+
+func (x *extractor) untarReader(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		target, err := x.target(hdr.Name, hdr.Typeflag == tar.TypeDir)
+		if err != nil {
+			return err
+		}
+		if target == "" {
+			continue
+		}
+		a := attrs{mode: os.FileMode(hdr.Mode).Perm(), mtime: hdr.ModTime, uid: hdr.Uid, gid: hdr.Gid, hasOwner: true}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = x.mkdir(target, a)
+		case tar.TypeReg:
+			err = x.writeFile(target, tr, a)
+		case tar.TypeSymlink:
+			err = x.symlink(target, hdr.Linkname, a)
+		case tar.TypeLink:
+			err = x.hardlink(target, hdr.Linkname)
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			err = errors.New("archive entry " + hdr.Name + ": device and fifo entries are not allowed")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
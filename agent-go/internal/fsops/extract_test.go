@@ -0,0 +1,114 @@
+package fsops
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+type tarEntry struct {
+	name string
+	link string // symlink target; empty for a regular file
+	body string
+}
+
+// writeTar writes entries, in order, as a plain tar archive at p.
+func writeTar(t *testing.T, p string, entries []tarEntry) {
+	t.Helper()
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.body)), Typeflag: tar.TypeReg}
+		if e.link != "" {
+			hdr = &tar.Header{Name: e.name, Mode: 0777, Linkname: e.link, Typeflag: tar.TypeSymlink}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDecompressHostile(t *testing.T) {
+	dir, outside := newTree(t, nil)
+	up, err := filepath.Rel(filepath.Dir(dir), outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up = filepath.ToSlash(up)
+	base := Base{Dir: dir}
+
+	tests := []struct {
+		name    string
+		entries []tarEntry
+		// read is a path that must not reach the outside file afterwards
+		read string
+	}{
+		{"dotdot after link", []tarEntry{
+			{name: "d1/d2/x", link: "../.."},
+			{name: "d1/d2/l", link: "x/../" + up + "/victim"},
+		}, "d1/d2/l"},
+		{"dotdot after link created later", []tarEntry{
+			{name: "d1/d2/l", link: "x/../" + up + "/victim"},
+			{name: "d1/d2/x", link: "../.."},
+		}, "d1/d2/l"},
+		{"dir link then file through it", []tarEntry{
+			{name: "d1/d2/x", link: "../.."},
+			{name: "d1/d2/out", link: "x/../" + up},
+			{name: "d1/d2/out/victim", body: "pwned"},
+		}, "d1/d2/out/victim"},
+		{"plain relative escape", []tarEntry{{name: "esc", link: "../" + up + "/victim"}}, "esc"},
+		{"absolute link", []tarEntry{{name: "abs", link: filepath.Join(outside, "victim")}}, "abs"},
+		{"link to etc", []tarEntry{{name: "etc", link: "/etc/passwd"}}, "etc"},
+		{"path traversal", []tarEntry{{name: "../" + up + "/victim", body: "pwned"}}, ""},
+		{"absolute path", []tarEntry{{name: filepath.ToSlash(filepath.Join(outside, "victim")), body: "pwned"}}, ""},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archive := filepath.Join(dir, "hostile-"+strconv.Itoa(i)+".tar")
+			writeTar(t, archive, tt.entries)
+			if err := Decompress(base, "/", filepath.Base(archive), "/", ExtractOptions{}); err == nil {
+				t.Error("hostile archive extracted without error")
+			}
+			if tt.read != "" {
+				if got, err := Read(base, tt.read); err == nil {
+					t.Errorf("read %s returned %q", tt.read, got)
+				}
+			}
+			if got := readFile(t, filepath.Join(outside, "victim")); got != "outside" {
+				t.Fatalf("outside file changed to %q", got)
+			}
+		})
+	}
+}
+
+func TestDecompressLinksInside(t *testing.T) {
+	dir, _ := newTree(t, nil)
+	base := Base{Dir: dir}
+	writeTar(t, filepath.Join(dir, "ok.tar"), []tarEntry{
+		{name: "world/level.dat", body: "level"},
+		{name: "world/latest", link: "level.dat"},
+		{name: "plugins/up", link: "../world/./latest"},
+		{name: "plugins/later", link: "conf/app.yml"},
+		{name: "plugins/conf/app.yml", body: "app"},
+	})
+	if err := Decompress(base, "/", "ok.tar", "/", ExtractOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for p, want := range map[string]string{"world/latest": "level", "plugins/up": "level", "plugins/later": "app"} {
+		if got, err := Read(base, p); err != nil || got != want {
+			t.Errorf("read %s = %q, %v; want %q", p, got, err, want)
+		}
+	}
+}
@@ -1,11 +1,7 @@
 package fsops
 
 import (
-	"archive/tar"
 	"archive/zip"
-	"compress/gzip"
-	"crypto/rand"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -15,7 +11,6 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
@@ -33,27 +28,40 @@ type FileInfo struct {
 	ModifiedAt string `json:"modifiedAt"`
 }
 
-func ResolveBase(root string, volumeMap, containerMap map[string]string, serverId string) string {
+// ResolveBase returns the directory a server's files live in. Volumes are
+// always under root: an absolute volume that already starts with root is
+// used as is, any other is joined under root. A configured volume or
+// container directory that does not exist is an error rather than a reason
+// to fall back to root.
+func ResolveBase(root, volume, container string) (string, error) {
 	if root == "" {
-		return ""
+		return "", errors.New("fileRoot not configured")
 	}
 	base := root
-	if v, ok := volumeMap[serverId]; ok && v != "" {
-		base = filepath.Join(root, v)
-	} else if c, ok := containerMap[serverId]; ok && c != "" {
-		base = filepath.Join(root, c)
+	if volume != "" && filepath.IsAbs(volume) && isSubPath(root, volume) {
+		base = filepath.Clean(volume)
+	} else if volume != "" {
+		base = filepath.Join(root, volume)
+	} else if container != "" {
+		base = filepath.Join(root, container)
+	}
+	if !isSubPath(root, base) {
+		return "", fmt.Errorf("server directory %s is outside fileRoot", base)
 	}
-	if _, err := os.Stat(base); err == nil {
-		return base
+	if _, err := os.Stat(base); err != nil {
+		return "", fmt.Errorf("server directory %s not found", base)
 	}
-	return root
+	return base, nil
 }
 
-func List(base, path string) ([]FileInfo, error) {
-	abs, err := safePath(base, path)
+func List(base Base, path string) ([]FileInfo, error) {
+	abs, err := base.safePath(path)
 	if err != nil {
 		return nil, err
 	}
+	if err := base.checkAccess(abs, OpRead); err != nil {
+		return nil, err
+	}
 	entries, err := os.ReadDir(abs)
 	if err != nil {
 		return nil, err
@@ -84,11 +92,14 @@ func List(base, path string) ([]FileInfo, error) {
 	return out, nil
 }
 
-func Read(base, path string) (string, error) {
-	abs, err := safePath(base, path)
+func Read(base Base, path string) (string, error) {
+	abs, err := base.safePath(path)
 	if err != nil {
 		return "", err
 	}
+	if err := base.checkAccess(abs, OpRead); err != nil {
+		return "", err
+	}
 	data, err := os.ReadFile(abs)
 	if err != nil {
 		return "", err
@@ -96,40 +107,68 @@ func Read(base, path string) (string, error) {
 	return string(data), nil
 }
 
-func Write(base, path, content string) error {
-	abs, err := safePath(base, path)
+func Write(base Base, path, content string) error {
+	abs, err := base.safePath(path)
 	if err != nil {
 		return err
 	}
+	if err := base.checkAccess(abs, OpWrite); err != nil {
+		return err
+	}
 	return os.WriteFile(abs, []byte(content), 0644)
 }
 
-func Chmod(base, path, mode string) error {
-	abs, err := safePath(base, path)
+func Chmod(base Base, path, mode string) error {
+	abs, err := base.safePath(path)
 	if err != nil {
 		return err
 	}
-	parsed, err := strconv.ParseUint(strings.TrimPrefix(mode, "0"), 8, 32)
+	if err := base.checkAccess(abs, OpWrite); err != nil {
+		return err
+	}
+	parsed, err := parseMode(mode)
 	if err != nil {
 		return err
 	}
-	return os.Chmod(abs, os.FileMode(parsed))
+	return os.Chmod(abs, parsed)
+}
+
+// parseMode reads an octal permission string such as "0755".
+func parseMode(mode string) (os.FileMode, error) {
+	parsed, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid mode %q", mode)
+	}
+	return os.FileMode(parsed), nil
 }
 
-func Mkdir(base, root, name string) error {
-	abs, err := safePath(base, filepath.Join(root, name))
+func Mkdir(base Base, root, name string) error {
+	abs, err := base.safePath(filepath.Join(root, name))
 	if err != nil {
 		return err
 	}
+	if err := base.checkAccess(abs, OpWrite); err != nil {
+		return err
+	}
 	return os.MkdirAll(abs, 0755)
 }
 
-func Delete(base, root string, files []string) error {
+func Delete(base Base, root string, files []string) error {
+	targets := make([]string, 0, len(files))
 	for _, name := range files {
-		abs, err := safePath(base, filepath.Join(root, name))
+		abs, err := base.safeLinkPath(filepath.Join(root, name))
 		if err != nil {
 			return err
 		}
+		if err := base.checkNotBase(abs); err != nil {
+			return err
+		}
+		if err := base.checkTree(abs, OpDelete); err != nil {
+			return err
+		}
+		targets = append(targets, abs)
+	}
+	for _, abs := range targets {
 		if err := os.RemoveAll(abs); err != nil {
 			return err
 		}
@@ -137,183 +176,176 @@ func Delete(base, root string, files []string) error {
 	return nil
 }
 
-func Rename(base, root, from, to string) error {
-	src, err := safePath(base, filepath.Join(root, from))
+func Rename(base Base, root, from, to string) error {
+	src, err := base.safeLinkPath(filepath.Join(root, from))
 	if err != nil {
 		return err
 	}
-	dst, err := safePath(base, filepath.Join(root, to))
+	dst, err := base.safePath(filepath.Join(root, to))
 	if err != nil {
 		return err
 	}
+	for _, abs := range []string{src, dst} {
+		if err := base.checkNotBase(abs); err != nil {
+			return err
+		}
+	}
+	if err := base.checkTree(src, OpDelete); err != nil {
+		return err
+	}
+	// rename replaces a symlink at dst rather than writing through it
+	if err := base.checkName(dst, OpWrite); err != nil {
+		return err
+	}
 	return os.Rename(src, dst)
 }
 
-func Copy(base, location string) error {
-	src, err := safePath(base, location)
+func Copy(base Base, location string, preserveOwner bool) error {
+	src, err := base.safePath(location)
 	if err != nil {
 		return err
 	}
 	ext := path.Ext(src)
 	name := strings.TrimSuffix(filepath.Base(src), ext)
 	dstName := fmt.Sprintf("%s-copy%s", name, ext)
-	dst, err := safePath(base, filepath.Join(filepath.Dir(location), dstName))
+	dst, err := base.safePath(filepath.Join(filepath.Dir(location), dstName))
 	if err != nil {
 		return err
 	}
-	return copyPath(src, dst)
+	if err := base.checkTree(src, OpRead); err != nil {
+		return err
+	}
+	if err := base.checkAccess(dst, OpWrite); err != nil {
+		return err
+	}
+	return copyPath(base, src, dst, preserveOwner)
 }
 
-func Compress(base, root string, files []string) (string, error) {
+func Compress(base Base, root string, files []string, format, name string) (string, error) {
 	if len(files) == 0 {
 		return "", errors.New("no files")
 	}
-	archiveName := fmt.Sprintf("archive-%d.zip", time.Now().Unix())
-	archivePath, err := safePath(base, filepath.Join(root, archiveName))
+	archiveName, err := archiveName(name, format)
+	if err != nil {
+		return "", err
+	}
+	archivePath, err := base.safePath(filepath.Join(root, archiveName))
 	if err != nil {
 		return "", err
 	}
+	if err := base.checkAccess(archivePath, OpWrite); err != nil {
+		return "", err
+	}
 
-	if err := zipPaths(archivePath, base, root, files); err != nil {
+	if err := writeArchive(archivePath, format, base, root, files); err != nil {
+		_ = os.Remove(archivePath)
 		return "", err
 	}
 	return archiveName, nil
 }
 
-func Decompress(base, root, file string) error {
-	abs, err := safePath(base, filepath.Join(root, file))
-	if err != nil {
+// Decompress extracts an archive into dest, or next to the archive when
+// dest is empty.
+func Decompress(base Base, root, file, dest string, opts ExtractOptions) error {
+	if err := opts.validate(); err != nil {
 		return err
 	}
-	if strings.HasSuffix(file, ".zip") {
-		return unzip(abs, filepath.Dir(abs))
-	}
-	if strings.HasSuffix(file, ".tar.gz") || strings.HasSuffix(file, ".tgz") {
-		return untarGz(abs, filepath.Dir(abs))
-	}
-	if strings.HasSuffix(file, ".tar") {
-		return untar(abs, filepath.Dir(abs))
-	}
-	return errors.New("unsupported archive type")
-}
-
-type UploadSession struct {
-	tempFile *os.File
-	target   string
-	size     int64
-	index    int
-}
-
-func NewUpload(base, path string, size int64) (*UploadSession, error) {
-	abs, err := safePath(base, path)
+	abs, err := base.safePath(filepath.Join(root, file))
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if err := os.MkdirAll(filepath.Dir(abs), 0755); err != nil {
-		return nil, err
+	if err := base.checkAccess(abs, OpRead); err != nil {
+		return err
 	}
-	tmp, err := os.CreateTemp(os.TempDir(), "agent-upload-*")
+	destAbs, err := extractDest(base, abs, dest)
 	if err != nil {
-		return nil, err
-	}
-	return &UploadSession{tempFile: tmp, target: abs, size: size, index: 0}, nil
-}
-
-func (u *UploadSession) WriteChunk(idx int, data []byte) error {
-	if idx != u.index {
-		return fmt.Errorf("unexpected chunk index")
-	}
-	if _, err := u.tempFile.Write(data); err != nil {
 		return err
 	}
-	u.index++
-	return nil
-}
-
-func (u *UploadSession) Commit() error {
-	if err := u.tempFile.Close(); err != nil {
+	info, err := os.Stat(abs)
+	if err != nil {
 		return err
 	}
-	return os.Rename(u.tempFile.Name(), u.target)
-}
-
-type DownloadSession struct {
-	ID   string
-	file *os.File
-	size int64
-}
-
-var (
-	downloadMu sync.Mutex
-	downloads  = map[string]*DownloadSession{}
-)
-
-func NewDownload(base, path string) (*DownloadSession, error) {
-	abs, err := safePath(base, path)
+	format, err := detectFormat(abs)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	f, err := os.Open(abs)
-	if err != nil {
-		return nil, err
+	x := &extractor{base: base, dest: destAbs, opts: opts, sel: newSelection(opts.Entries), archiveSize: info.Size(), moved: map[string]string{}}
+	if _, err := os.Lstat(destAbs); err != nil {
+		if err := os.MkdirAll(destAbs, 0755); err != nil {
+			return err
+		}
+		x.created = append(x.created, destAbs)
+	}
+	switch format.kind {
+	case kindZip:
+		err = x.unzip(abs)
+	case kindTar:
+		err = x.untar(abs, format.compression)
+	case kindRaw:
+		err = x.unpackRaw(abs, format.compression)
+	}
+	if err == nil && format.kind != kindRaw {
+		err = x.sel.missing()
+	}
+	if err == nil {
+		err = finishDirs(x.dirs, opts.PreserveOwner)
 	}
-	info, err := f.Stat()
 	if err != nil {
-		_ = f.Close()
-		return nil, err
+		x.cleanup()
 	}
-	id := randID()
-	s := &DownloadSession{ID: id, file: f, size: info.Size()}
-	downloadMu.Lock()
-	downloads[id] = s
-	downloadMu.Unlock()
-	return s, nil
+	return err
 }
 
-func ReadChunk(id string, index int) ([]byte, bool, error) {
-	downloadMu.Lock()
-	s := downloads[id]
-	downloadMu.Unlock()
-	if s == nil {
-		return nil, false, errors.New("download not found")
+func extractDest(base Base, archive, dest string) (string, error) {
+	if dest == "" {
+		return filepath.Dir(archive), nil
 	}
-
-	offset := int64(index * chunkSize)
-	if offset >= s.size {
-		closeDownload(id)
-		return nil, true, nil
+	abs, err := base.safePath(dest)
+	if err != nil {
+		return "", err
 	}
-	buf := make([]byte, chunkSize)
-	n, err := s.file.ReadAt(buf, offset)
-	if err != nil && err != io.EOF {
-		return nil, false, err
+	if info, err := os.Stat(abs); err == nil && !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", relPath(base.Dir, abs))
 	}
-	done := offset+int64(n) >= s.size
-	if done {
-		closeDownload(id)
+	if err := base.checkAccess(abs, OpWrite); err != nil {
+		return "", err
 	}
-	return buf[:n], done, nil
+	return abs, nil
 }
 
-func closeDownload(id string) {
-	downloadMu.Lock()
-	s := downloads[id]
-	delete(downloads, id)
-	downloadMu.Unlock()
-	if s != nil {
-		_ = s.file.Close()
+func (base Base) safePath(path string) (string, error) {
+	if base.Dir == "" {
+		return "", errors.New("fileRoot not configured")
+	}
+	cleaned := filepath.Clean(filepath.Join(base.Dir, path))
+	if !isSubPath(base.Dir, cleaned) {
+		return "", errors.New("path is outside base")
 	}
+	return resolveBeneath(base.Dir, cleaned, true)
 }
 
-func safePath(base, path string) (string, error) {
-	if base == "" {
+// safeLinkPath is safePath for operations that act on a symlink itself
+// (remove, move) and never follow it.
+func (base Base) safeLinkPath(path string) (string, error) {
+	if base.Dir == "" {
 		return "", errors.New("fileRoot not configured")
 	}
-	cleaned := filepath.Clean(filepath.Join(base, path))
-	if !isSubPath(base, cleaned) {
+	cleaned := filepath.Clean(filepath.Join(base.Dir, path))
+	if !isSubPath(base.Dir, cleaned) {
 		return "", errors.New("path is outside base")
 	}
-	return cleaned, nil
+	return resolveBeneath(base.Dir, cleaned, false)
+}
+
+var errBaseDir = errors.New("cannot delete or move the server directory itself")
+
+// checkNotBase refuses abs when it is the base directory, which DELETE and
+// RENAME would otherwise remove or move wholesale.
+func (base Base) checkNotBase(abs string) error {
+	if filepath.Clean(abs) == filepath.Clean(base.Dir) {
+		return errBaseDir
+	}
+	return nil
 }
 
 func isSubPath(base, target string) bool {
@@ -333,44 +365,119 @@ func startsWithDotDot(rel string) bool {
 	return rel == ".." || (len(rel) >= 3 && rel[:3] == ".."+string(os.PathSeparator))
 }
 
-func randID() string {
-	b := make([]byte, 12)
-	_, _ = rand.Read(b)
-	return hex.EncodeToString(b)
-}
-
-func copyPath(src, dst string) error {
+func copyPath(base Base, src, dst string, preserveOwner bool) error {
 	info, err := os.Stat(src)
 	if err != nil {
 		return err
 	}
 	if info.IsDir() {
-		return copyDir(src, dst)
+		return copyDir(base, src, dst, preserveOwner)
 	}
-	return copyFile(src, dst)
+	return copyFile(src, dst, attrsFromInfo(info), preserveOwner)
 }
 
-func copyDir(src, dst string) error {
-	if err := os.MkdirAll(dst, 0755); err != nil {
-		return err
-	}
-	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+func copyDir(base Base, src, dst string, preserveOwner bool) error {
+	var dirs []pendingDir
+	// links are created last, so the check of where they lead sees the
+	// copied tree rather than whatever it replaces
+	var links []pendingLink
+	err := filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
 		if err != nil {
 			return err
 		}
 		rel, _ := filepath.Rel(src, p)
-		if rel == "." {
-			return nil
+		target, err := base.copyTarget(filepath.Join(dst, rel))
+		if err != nil {
+			return err
 		}
-		target := filepath.Join(dst, rel)
-		if d.IsDir() {
+		switch {
+		case d.IsDir():
+			dirs = append(dirs, pendingDir{path: target, attrs: attrsFromInfo(info)})
+			if err := replaceLink(target); err != nil {
+				return err
+			}
 			return os.MkdirAll(target, 0755)
+		case d.Type()&fs.ModeSymlink != 0:
+			links = append(links, pendingLink{src: p, dst: target, attrs: attrsFromInfo(info)})
+			return nil
+		case !d.Type().IsRegular():
+			return nil
 		}
-		return copyFile(p, target)
+		return copyFile(p, target, attrsFromInfo(info), preserveOwner)
 	})
+	if err != nil {
+		return err
+	}
+	for _, l := range links {
+		if err := copySymlink(base, l.src, l.dst, l.attrs, preserveOwner); err != nil {
+			return err
+		}
+	}
+	return finishDirs(dirs, preserveOwner)
+}
+
+type pendingLink struct {
+	src, dst string
+	attrs    attrs
 }
 
-func copyFile(src, dst string) error {
+// copyTarget confines target, a path inside a copy, and checks it may be
+// written. It is called for every entry rather than once for the copy's
+// root, since what is already at the destination may hold symlinks.
+func (base Base) copyTarget(target string) (string, error) {
+	rel, err := filepath.Rel(base.Dir, target)
+	if err != nil {
+		return "", err
+	}
+	abs, err := base.safeLinkPath(rel)
+	if err != nil {
+		return "", err
+	}
+	if err := base.checkName(abs, OpWrite); err != nil {
+		return "", err
+	}
+	return abs, nil
+}
+
+// replaceLink removes a symlink at p, so it is replaced rather than
+// written through.
+func replaceLink(p string) error {
+	if info, err := os.Lstat(p); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return os.Remove(p)
+	}
+	return nil
+}
+
+// copySymlink recreates the link at dst with the same target, provided the
+// target is inside base from both the old and the new location.
+func copySymlink(base Base, src, dst string, a attrs, preserveOwner bool) error {
+	if err := base.confined(src); err != nil {
+		return err
+	}
+	link, err := os.Readlink(src)
+	if err != nil {
+		return err
+	}
+	if err := base.checkNewLink(dst, link); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := replaceLink(dst); err != nil {
+		return err
+	}
+	if err := os.Symlink(link, dst); err != nil {
+		return err
+	}
+	return a.apply(dst, true, preserveOwner)
+}
+
+func copyFile(src, dst string, a attrs, preserveOwner bool) error {
 	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
 		return err
 	}
@@ -379,49 +486,81 @@ func copyFile(src, dst string) error {
 		return err
 	}
 	defer in.Close()
-	out, err := os.Create(dst)
+	if err := replaceLink(dst); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, a.mode)
 	if err != nil {
 		return err
 	}
-	defer out.Close()
 	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
 		return err
 	}
-	return out.Sync()
-}
-
-func zipPaths(archivePath, base, root string, files []string) error {
-	out, err := os.Create(archivePath)
-	if err != nil {
+	if err := out.Sync(); err != nil {
+		out.Close()
 		return err
 	}
-	defer out.Close()
-
-	zw := zip.NewWriter(out)
-	defer zw.Close()
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return a.apply(dst, false, preserveOwner)
+}
 
+func zipPaths(w io.Writer, archivePath string, base Base, root string, files []string) error {
+	zw := zip.NewWriter(w)
 	for _, name := range files {
-		abs, err := safePath(base, filepath.Join(root, name))
+		abs, err := base.safePath(filepath.Join(root, name))
 		if err != nil {
 			return err
 		}
+		if err := base.checkTree(abs, OpRead); err != nil {
+			return err
+		}
 		err = filepath.Walk(abs, func(p string, info os.FileInfo, err error) error {
 			if err != nil {
 				return err
 			}
-			if info.IsDir() {
+			if p == archivePath {
 				return nil
 			}
-			relRoot := filepath.Join(root, name)
-			relPath, _ := filepath.Rel(filepath.Join(base, root), p)
-			if relPath == "" {
+			if info.IsDir() && base.isStaging(p) {
+				return filepath.SkipDir
+			}
+			relPath, _ := filepath.Rel(filepath.Join(base.Dir, root), p)
+			if relPath == "" || relPath == "." {
 				relPath = filepath.Base(p)
 			}
 			header, err := zip.FileInfoHeader(info)
 			if err != nil {
 				return err
 			}
-			header.Name = relPath
+			header.Name = filepath.ToSlash(relPath)
+			header.Modified = info.ModTime()
+			switch {
+			case info.IsDir():
+				header.Name += "/"
+				_, err := zw.CreateHeader(header)
+				return err
+			case info.Mode()&os.ModeSymlink != 0:
+				if err := base.confined(p); err != nil {
+					return err
+				}
+				link, err := os.Readlink(p)
+				if err != nil {
+					return err
+				}
+				header.Method = zip.Store
+				writer, err := zw.CreateHeader(header)
+				if err != nil {
+					return err
+				}
+				_, err = io.WriteString(writer, link)
+				return err
+			case !info.Mode().IsRegular():
+				return nil
+			}
+			header.Method = zip.Deflate
 			writer, err := zw.CreateHeader(header)
 			if err != nil {
 				return err
@@ -431,110 +570,12 @@ func zipPaths(archivePath, base, root string, files []string) error {
 				return err
 			}
 			defer file.Close()
-			if _, err := io.Copy(writer, file); err != nil {
-				return err
-			}
-			_ = relRoot
-			return nil
-		})
-		if err != nil {
+			_, err = io.Copy(writer, file)
 			return err
-		}
-	}
-	return nil
-}
-
-func unzip(archivePath, dest string) error {
-	r, err := zip.OpenReader(archivePath)
-	if err != nil {
-		return err
-	}
-	defer r.Close()
-
-	for _, f := range r.File {
-		target := filepath.Join(dest, f.Name)
-		if f.FileInfo().IsDir() {
-			if err := os.MkdirAll(target, 0755); err != nil {
-				return err
-			}
-			continue
-		}
-		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
-			return err
-		}
-		rc, err := f.Open()
-		if err != nil {
-			return err
-		}
-		out, err := os.Create(target)
-		if err != nil {
-			rc.Close()
-			return err
-		}
-		if _, err := io.Copy(out, rc); err != nil {
-			rc.Close()
-			out.Close()
-			return err
-		}
-		rc.Close()
-		out.Close()
-	}
-	return nil
-}
-
-func untarGz(archivePath, dest string) error {
-	f, err := os.Open(archivePath)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	gz, err := gzip.NewReader(f)
-	if err != nil {
-		return err
-	}
-	defer gz.Close()
-	return untarReader(gz, dest)
-}
-
-func untar(archivePath, dest string) error {
-	f, err := os.Open(archivePath)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	return untarReader(f, dest)
-}
-
-func untarReader(r io.Reader, dest string) error {
-	tr := tar.NewReader(r)
-	for {
-		hdr, err := tr.Next()
-		if err == io.EOF {
-			break
-		}
+		})
 		if err != nil {
 			return err
 		}
-		target := filepath.Join(dest, hdr.Name)
-		switch hdr.Typeflag {
-		case tar.TypeDir:
-			if err := os.MkdirAll(target, 0755); err != nil {
-				return err
-			}
-		case tar.TypeReg:
-			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
-				return err
-			}
-			out, err := os.Create(target)
-			if err != nil {
-				return err
-			}
-			if _, err := io.Copy(out, tr); err != nil {
-				out.Close()
-				return err
-			}
-			out.Close()
-		}
 	}
-	return nil
+	return zw.Close()
 }
@@ -0,0 +1,128 @@
+package fsops
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+type Op string
+
+const (
+	OpRead   Op = "read"
+	OpWrite  Op = "write"
+	OpDelete Op = "delete"
+)
+
+// Protection lists glob patterns, relative to a server base, that file
+// actions may never read, write or delete. Patterns containing a slash
+// match the path from the base ("/world/*.dat"); others match any path
+// element ("server.jar", "*.key"). A match on a directory covers
+// everything below it.
+type Protection struct {
+	ReadDeny   []string
+	WriteDeny  []string
+	DeleteDeny []string
+}
+
+type ProtectedError struct {
+	Path string
+	Op   Op
+}
+
+func (e *ProtectedError) Error() string {
+	return fmt.Sprintf("policy: %s is %s-protected", e.Path, e.Op)
+}
+
+// Base is the directory a server's file actions are confined to, with the
+// paths under it they may not touch. Every operation gets it explicitly,
+// so servers sharing a directory cannot change each other's patterns.
+type Base struct {
+	Dir     string
+	Protect Protection
+}
+
+func (p Protection) patterns(op Op) []string {
+	switch op {
+	case OpRead:
+		return p.ReadDeny
+	case OpWrite:
+		return p.WriteDeny
+	case OpDelete:
+		return p.DeleteDeny
+	}
+	return nil
+}
+
+// checkAccess checks abs for an operation that follows it: when its last
+// element is a symlink, every path along the link chain must be allowed
+// too, so a link cannot be used to reach a protected file.
+func (base Base) checkAccess(abs string, op Op) error {
+	if len(base.Protect.patterns(op)) == 0 {
+		return nil
+	}
+	paths, err := base.targets(abs)
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		if err := base.checkName(p, op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkName checks abs itself without following a symlink in its last
+// element, for operations that act on the link.
+func (base Base) checkName(abs string, op Op) error {
+	patterns := base.Protect.patterns(op)
+	if len(patterns) == 0 {
+		return nil
+	}
+	rel := relPath(base.Dir, abs)
+	if isProtected(patterns, rel) {
+		return &ProtectedError{Path: rel, Op: op}
+	}
+	return nil
+}
+
+// checkTree applies checkName to abs and, for directories, to everything
+// below it, so removing or reading a parent cannot reach a protected child.
+// Tree operations store, copy and remove symlinks as links, so none are
+// followed.
+func (base Base) checkTree(abs string, op Op) error {
+	if len(base.Protect.patterns(op)) == 0 {
+		return nil
+	}
+	return filepath.WalkDir(abs, func(pth string, d fs.DirEntry, err error) error {
+		if err != nil && pth != abs {
+			return err
+		}
+		return base.checkName(pth, op)
+	})
+}
+
+func isProtected(patterns []string, rel string) bool {
+	rel = strings.TrimPrefix(path.Clean("/"+rel), "/")
+	if rel == "" {
+		return false
+	}
+	parts := strings.Split(rel, "/")
+	for _, pattern := range patterns {
+		anchored := strings.Contains(strings.TrimSuffix(pattern, "/"), "/")
+		pattern = strings.Trim(pattern, "/")
+		for i := range parts {
+			if anchored {
+				if ok, _ := path.Match(pattern, strings.Join(parts[:i+1], "/")); ok {
+					return true
+				}
+			} else if ok, _ := path.Match(pattern, parts[i]); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,260 @@
+package fsops
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// stagingDir holds in-progress writes under each base, so the final
+// rename usually stays on one filesystem; Commit copies across when it
+// does not. Archives leave it out.
+const stagingDir = ".agent-uploads"
+
+// stagingPrefix starts every staged file's name.
+const stagingPrefix = "upload-"
+
+type UploadOptions struct {
+	// SHA256 is the expected whole-file digest (hex), if known up front.
+	SHA256 string
+	// Overwrite allows replacing an existing file.
+	Overwrite bool
+	// Mode is an octal permission string such as "0644". Empty keeps the
+	// mode of the file being replaced, or 0644 for new files.
+	Mode string
+}
+
+// StagedFile is written in the staging directory and moved to its target
+// by Commit.
+type StagedFile struct {
+	file   *os.File
+	base   Base
+	target string
+	opts   UploadOptions
+	mode   os.FileMode
+	closed bool
+}
+
+func NewStagedFile(base Base, path string, opts UploadOptions) (*StagedFile, error) {
+	var mode os.FileMode
+	if opts.Mode != "" {
+		parsed, err := parseMode(opts.Mode)
+		if err != nil {
+			return nil, err
+		}
+		mode = parsed.Perm()
+	}
+	abs, err := base.safePath(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := base.checkAccess(abs, OpWrite); err != nil {
+		return nil, err
+	}
+	if info, err := os.Lstat(abs); err == nil {
+		if info.IsDir() {
+			return nil, fmt.Errorf("%s is a directory", relPath(base.Dir, abs))
+		}
+		if !opts.Overwrite {
+			return nil, fmt.Errorf("%s already exists", relPath(base.Dir, abs))
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(abs), 0755); err != nil {
+		return nil, err
+	}
+	f, err := createStaging(base)
+	if err != nil {
+		return nil, err
+	}
+	return &StagedFile{file: f, base: base, target: abs, opts: opts, mode: mode}, nil
+}
+
+// Path is the target path relative to the base.
+func (s *StagedFile) Path() string { return relPath(s.base.Dir, s.target) }
+
+func (s *StagedFile) Write(p []byte) (int, error) { return s.file.Write(p) }
+
+func (s *StagedFile) WriteAt(p []byte, off int64) (int, error) { return s.file.WriteAt(p, off) }
+
+func (s *StagedFile) ReadAt(p []byte, off int64) (int, error) { return s.file.ReadAt(p, off) }
+
+func (s *StagedFile) Truncate(size int64) error { return s.file.Truncate(size) }
+
+func (s *StagedFile) Size() (int64, error) {
+	info, err := s.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Commit fsyncs the staged file and renames it over the target, or links
+// it into place when overwriting is not allowed so an existing file is
+// never clobbered. If the target appeared in the meantime nothing is
+// changed and the file stays staged.
+func (s *StagedFile) Commit() error {
+	if s.closed {
+		return fmt.Errorf("%s already finished", s.Path())
+	}
+	mode := s.mode
+	existing, statErr := os.Lstat(s.target)
+	if statErr == nil && !s.opts.Overwrite {
+		return fmt.Errorf("%s already exists", s.Path())
+	}
+	if mode == 0 {
+		mode = 0644
+		if statErr == nil && existing.Mode().IsRegular() {
+			mode = existing.Mode().Perm()
+		}
+	}
+	if err := s.file.Chmod(mode); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.closed = true
+	defer s.remove()
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	err := s.place(s.file.Name())
+	if isCrossDevice(err) {
+		err = s.placeCopy(s.file.Name(), mode)
+	}
+	if err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(s.target))
+	return nil
+}
+
+// place renames src over the target, or links it when overwriting is not
+// allowed.
+func (s *StagedFile) place(src string) error {
+	if s.opts.Overwrite {
+		return os.Rename(src, s.target)
+	}
+	return os.Link(src, s.target)
+}
+
+// placeCopy handles a target on another filesystem than the staging
+// directory, e.g. a mount inside the base: the staged file is copied next
+// to the target and fsynced, then placed from there, so the target still
+// changes in a single step.
+func (s *StagedFile) placeCopy(src string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.CreateTemp(filepath.Dir(s.target), "."+stagingPrefix+"*")
+	if err != nil {
+		return err
+	}
+	// gone after a rename; after a link only the extra name is removed
+	defer os.Remove(out.Name())
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Chmod(mode)
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return s.place(out.Name())
+}
+
+// Abort deletes the staged file.
+func (s *StagedFile) Abort() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	err := s.file.Close()
+	s.remove()
+	return err
+}
+
+// TempPath is where the file is staged until it is committed or aborted.
+func (s *StagedFile) TempPath() string { return s.file.Name() }
+
+// Closed reports whether the file was committed or aborted.
+func (s *StagedFile) Closed() bool { return s.closed }
+
+// remove deletes the staging file (if still there) and the staging
+// directory once nothing else uses it.
+func (s *StagedFile) remove() {
+	_ = os.Remove(s.file.Name())
+	_ = os.Remove(filepath.Dir(s.file.Name()))
+}
+
+// isStaging reports whether p is the base's staging directory.
+func (base Base) isStaging(p string) bool {
+	return p == filepath.Join(base.Dir, stagingDir)
+}
+
+// SweepStaging deletes staged files under dir that are not in keep and
+// have not been written for minAge: leftovers of uploads and fetches that
+// were neither committed nor aborted, e.g. because the agent stopped. It
+// returns how many it removed.
+func SweepStaging(dir string, keep map[string]bool, minAge time.Duration) (int, error) {
+	staging := filepath.Join(dir, stagingDir)
+	entries, err := os.ReadDir(staging)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	cutoff := time.Now().Add(-minAge)
+	removed := 0
+	for _, e := range entries {
+		p := filepath.Join(staging, e.Name())
+		if !e.Type().IsRegular() || !strings.HasPrefix(e.Name(), stagingPrefix) || keep[p] {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		if err := os.Remove(p); err == nil {
+			removed++
+		}
+	}
+	// only succeeds once the directory is empty
+	_ = os.Remove(staging)
+	return removed, nil
+}
+
+func createStaging(base Base) (*os.File, error) {
+	staging := filepath.Join(base.Dir, stagingDir)
+	for attempt := 0; ; attempt++ {
+		if err := os.MkdirAll(staging, 0700); err != nil {
+			return nil, err
+		}
+		f, err := os.CreateTemp(staging, stagingPrefix+"*")
+		// another upload may have just removed the empty directory
+		if os.IsNotExist(err) && attempt == 0 {
+			continue
+		}
+		return f, err
+	}
+}
+
+// syncDir makes a rename durable. Not every platform can sync a
+// directory, so failures are ignored.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		_ = d.Close()
+	}
+}
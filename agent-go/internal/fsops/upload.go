@@ -0,0 +1,211 @@
+package fsops
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// UploadSession receives a file in fixed-size chunks. Chunks may arrive in
+// any order, concurrently and more than once; each is written at
+// index*chunkSize in a staging file preallocated to the declared size.
+type UploadSession struct {
+	// fileMu is held shared while chunks are written and exclusively
+	// while the upload is verified and committed.
+	fileMu   sync.RWMutex
+	mu       sync.Mutex
+	staged   *StagedFile
+	opts     UploadOptions
+	size     int64
+	chunks   int
+	received bitmap
+	sums     [][sha256.Size]byte
+	done     bool
+}
+
+type UploadStatus struct {
+	Size      int64 `json:"size"`
+	ChunkSize int   `json:"chunkSize"`
+	Chunks    int   `json:"chunks"`
+	Received  int   `json:"received"`
+	Missing   []int `json:"missing"`
+}
+
+func NewUpload(base Base, path string, size int64, opts UploadOptions) (*UploadSession, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("invalid size %d", size)
+	}
+	if opts.SHA256 != "" && !isSHA256(opts.SHA256) {
+		return nil, fmt.Errorf("invalid sha256 %q", opts.SHA256)
+	}
+	staged, err := NewStagedFile(base, path, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := staged.Truncate(size); err != nil {
+		_ = staged.Abort()
+		return nil, err
+	}
+	chunks := int((size + chunkSize - 1) / chunkSize)
+	opts.SHA256 = strings.ToLower(opts.SHA256)
+	return &UploadSession{
+		staged:   staged,
+		opts:     opts,
+		size:     size,
+		chunks:   chunks,
+		received: newBitmap(chunks),
+		sums:     make([][sha256.Size]byte, chunks),
+	}, nil
+}
+
+func (u *UploadSession) ChunkSize() int { return chunkSize }
+
+// TempPath is the staged file the chunks are written to.
+func (u *UploadSession) TempPath() string { return u.staged.TempPath() }
+
+func (u *UploadSession) Chunks() int { return u.chunks }
+
+// chunkLen is the exact length chunk idx must have.
+func (u *UploadSession) chunkLen(idx int) int {
+	if idx == u.chunks-1 {
+		return int(u.size - int64(idx)*chunkSize)
+	}
+	return chunkSize
+}
+
+// WriteChunk stores chunk idx. sum, when set, is the chunk's hex SHA-256
+// and a mismatch rejects the chunk so it can be sent again.
+func (u *UploadSession) WriteChunk(idx int, data []byte, sum string) error {
+	if idx < 0 || idx >= u.chunks {
+		return fmt.Errorf("chunk index %d out of range (0..%d)", idx, u.chunks-1)
+	}
+	if want := u.chunkLen(idx); len(data) != want {
+		return fmt.Errorf("chunk %d has %d bytes, want %d", idx, len(data), want)
+	}
+	digest := sha256.Sum256(data)
+	if sum != "" && !strings.EqualFold(sum, hex.EncodeToString(digest[:])) {
+		return fmt.Errorf("chunk %d checksum mismatch", idx)
+	}
+	u.fileMu.RLock()
+	defer u.fileMu.RUnlock()
+	if u.done {
+		return fmt.Errorf("upload already finished")
+	}
+	if _, err := u.staged.WriteAt(data, int64(idx)*chunkSize); err != nil {
+		return err
+	}
+	u.mu.Lock()
+	u.sums[idx] = digest
+	u.received.set(idx)
+	u.mu.Unlock()
+	return nil
+}
+
+func (u *UploadSession) Status() UploadStatus {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	missing := u.received.missing(u.chunks)
+	return UploadStatus{
+		Size:      u.size,
+		ChunkSize: chunkSize,
+		Chunks:    u.chunks,
+		Received:  u.chunks - len(missing),
+		Missing:   missing,
+	}
+}
+
+// Commit checks that every chunk arrived, re-reads the staging file to
+// verify each chunk and the whole-file SHA-256, syncs it and moves it into
+// place. Chunks that fail verification are marked missing again.
+func (u *UploadSession) Commit(sum string) (string, error) {
+	u.fileMu.Lock()
+	defer u.fileMu.Unlock()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.done {
+		return "", fmt.Errorf("upload already finished")
+	}
+	if missing := u.received.missing(u.chunks); len(missing) > 0 {
+		return "", fmt.Errorf("upload incomplete: %d of %d chunks missing", len(missing), u.chunks)
+	}
+	if sum == "" {
+		sum = u.opts.SHA256
+	}
+	if sum != "" && !isSHA256(sum) {
+		return "", fmt.Errorf("invalid sha256 %q", sum)
+	}
+	if size, err := u.staged.Size(); err != nil {
+		return "", err
+	} else if size != u.size {
+		return "", fmt.Errorf("upload has %d bytes, declared %d", size, u.size)
+	}
+
+	whole := sha256.New()
+	buf := make([]byte, chunkSize)
+	var bad []int
+	for idx := 0; idx < u.chunks; idx++ {
+		n := u.chunkLen(idx)
+		if _, err := u.staged.ReadAt(buf[:n], int64(idx)*chunkSize); err != nil && err != io.EOF {
+			return "", err
+		}
+		if sha256.Sum256(buf[:n]) != u.sums[idx] {
+			bad = append(bad, idx)
+			u.received.clear(idx)
+		}
+		whole.Write(buf[:n])
+	}
+	if len(bad) > 0 {
+		return "", fmt.Errorf("chunks %v failed verification; send them again", bad)
+	}
+	got := hex.EncodeToString(whole.Sum(nil))
+	if sum != "" && !strings.EqualFold(sum, got) {
+		return "", fmt.Errorf("sha256 mismatch: got %s", got)
+	}
+
+	err := u.staged.Commit()
+	u.done = u.staged.Closed()
+	if err != nil {
+		return "", err
+	}
+	return got, nil
+}
+
+// Abort stops the upload and deletes the temp file.
+func (u *UploadSession) Abort() error {
+	u.fileMu.Lock()
+	defer u.fileMu.Unlock()
+	if u.done {
+		return nil
+	}
+	u.done = true
+	return u.staged.Abort()
+}
+
+func isSHA256(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == sha256.Size
+}
+
+type bitmap []uint64
+
+func newBitmap(n int) bitmap { return make(bitmap, (n+63)/64) }
+
+func (b bitmap) set(i int)   { b[i/64] |= 1 << (i % 64) }
+func (b bitmap) clear(i int) { b[i/64] &^= 1 << (i % 64) }
+func (b bitmap) has(i int) bool {
+	return b[i/64]&(1<<(i%64)) != 0
+}
+
+// missing lists the unset indexes below n.
+func (b bitmap) missing(n int) []int {
+	out := []int{}
+	for i := 0; i < n; i++ {
+		if !b.has(i) {
+			out = append(out, i)
+		}
+	}
+	return out
+}
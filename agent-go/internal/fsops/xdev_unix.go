@@ -0,0 +1,14 @@
+//go:build !windows
+
+package fsops
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isCrossDevice reports whether a rename or link failed because source and
+// target are on different filesystems.
+func isCrossDevice(err error) bool {
+	return errors.Is(err, syscall.EXDEV)
+}
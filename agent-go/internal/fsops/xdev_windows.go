@@ -0,0 +1,17 @@
+//go:build windows
+
+package fsops
+
+import (
+	"errors"
+	"syscall"
+)
+
+// errNotSameDevice is ERROR_NOT_SAME_DEVICE.
+const errNotSameDevice = syscall.Errno(17)
+
+// isCrossDevice reports whether a rename or link failed because source and
+// target are on different volumes.
+func isCrossDevice(err error) bool {
+	return errors.Is(err, errNotSameDevice)
+}
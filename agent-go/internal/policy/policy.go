@@ -0,0 +1,148 @@
+package policy
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"minebot-agent/internal/config"
+)
+
+const (
+	EffectAllow = "allow"
+	EffectDeny  = "deny"
+)
+
+type Engine struct {
+	rules        []config.PolicyRule
+	defaultAllow bool
+}
+
+type Request struct {
+	ServerID string   `json:"serverId"`
+	Action   string   `json:"action"`
+	Paths    []string `json:"paths,omitempty"`
+	// Tree is set for actions that reach everything below their paths
+	// (DELETE, RENAME, COPY, COMPRESS, archive downloads). Deny rules then
+	// also match when their prefix lies under a request path.
+	Tree bool `json:"tree,omitempty"`
+}
+
+type Decision struct {
+	Allowed bool               `json:"allowed"`
+	Rule    int                `json:"rule"`
+	Matched *config.PolicyRule `json:"matched,omitempty"`
+	Path    string             `json:"path,omitempty"`
+	Reason  string             `json:"reason"`
+}
+
+func New(cfg config.PolicyConfig) *Engine {
+	defaultAllow := len(cfg.Rules) == 0
+	switch cfg.Default {
+	case EffectAllow:
+		defaultAllow = true
+	case EffectDeny:
+		defaultAllow = false
+	}
+	return &Engine{rules: cfg.Rules, defaultAllow: defaultAllow}
+}
+
+// Evaluate applies deny-overrides-allow: any matching deny rule refuses the
+// request, otherwise every path needs a matching allow rule (or the default
+// must be allow). Requests without paths only match rules without paths.
+func (e *Engine) Evaluate(req Request) Decision {
+	paths := req.Paths
+	if len(paths) == 0 {
+		paths = []string{""}
+	}
+
+	var allowed []Decision
+	for _, p := range paths {
+		p = normalize(p)
+		d, ok := e.evaluatePath(req, p)
+		if !d.Allowed {
+			return d
+		}
+		if ok {
+			allowed = append(allowed, d)
+		}
+	}
+	if len(allowed) == len(paths) {
+		return allowed[0]
+	}
+	return Decision{Allowed: true, Rule: -1, Reason: "no rule matched, default allow"}
+}
+
+func (e *Engine) evaluatePath(req Request, p string) (Decision, bool) {
+	allowIdx := -1
+	for i := range e.rules {
+		r := &e.rules[i]
+		if !e.matches(r, req, p, req.Tree && r.Effect == EffectDeny) {
+			continue
+		}
+		if r.Effect == EffectDeny {
+			return Decision{Allowed: false, Rule: i, Matched: r, Path: p, Reason: fmt.Sprintf("denied by rule %d", i)}, true
+		}
+		if allowIdx < 0 {
+			allowIdx = i
+		}
+	}
+	if allowIdx >= 0 {
+		r := &e.rules[allowIdx]
+		return Decision{Allowed: true, Rule: allowIdx, Matched: r, Path: p, Reason: fmt.Sprintf("allowed by rule %d", allowIdx)}, true
+	}
+	if !e.defaultAllow {
+		return Decision{Allowed: false, Rule: -1, Path: p, Reason: "no rule matched, default deny"}, true
+	}
+	return Decision{Allowed: true, Rule: -1, Path: p, Reason: "no rule matched, default allow"}, false
+}
+
+// matches reports whether r applies to p. With below set, a rule whose path
+// prefix lies under p applies as well.
+func (e *Engine) matches(r *config.PolicyRule, req Request, p string, below bool) bool {
+	if !matchAny(r.Servers, func(pattern string) bool {
+		ok, _ := path.Match(pattern, req.ServerID)
+		return ok
+	}) {
+		return false
+	}
+	if !matchAny(r.Actions, func(a string) bool { return a == "*" || a == req.Action }) {
+		return false
+	}
+	if len(r.Paths) == 0 {
+		return true
+	}
+	if p == "" {
+		return false
+	}
+	return matchAny(r.Paths, func(prefix string) bool {
+		prefix = normalize(prefix)
+		return hasPathPrefix(p, prefix) || (below && hasPathPrefix(prefix, p))
+	})
+}
+
+func matchAny(list []string, fn func(string) bool) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, item := range list {
+		if fn(item) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasPathPrefix(p, prefix string) bool {
+	if prefix == "/" || p == prefix {
+		return true
+	}
+	return strings.HasPrefix(p, prefix+"/")
+}
+
+func normalize(p string) string {
+	if p == "" {
+		return ""
+	}
+	return path.Clean("/" + strings.ReplaceAll(p, "\\", "/"))
+}
@@ -3,15 +3,64 @@ package protocol
 import "encoding/json"
 
 type Message struct {
-	Type    string          `json:"type"`
-	ID      string          `json:"id,omitempty"`
-	Action  string          `json:"action,omitempty"`
-	Payload json.RawMessage `json:"payload,omitempty"`
-	Ts      int64           `json:"ts"`
+	Type           string          `json:"type"`
+	ID             string          `json:"id,omitempty"`
+	Action         string          `json:"action,omitempty"`
+	IdempotencyKey string          `json:"idempotencyKey,omitempty"`
+	Scope          string          `json:"scope,omitempty"`
+	Sig            string          `json:"sig,omitempty"`
+	Payload        json.RawMessage `json:"payload,omitempty"`
+	Ts             int64           `json:"ts"`
 }
 
 type ResponsePayload struct {
 	Success bool        `json:"success"`
+	Code    string      `json:"code,omitempty"`
 	Message string      `json:"message,omitempty"`
 	Data    interface{} `json:"data,omitempty"`
 }
+
+var Actions = []string{
+	"START",
+	"STOP",
+	"RESTART",
+	"KILL",
+	"COMMAND",
+	"EXEC",
+	"STATS",
+	"HOST_STATS",
+	"PROCESS_LIST",
+	"LOGS",
+	"LIST",
+	"READ",
+	"WRITE",
+	"MKDIR",
+	"CHMOD",
+	"DELETE",
+	"RENAME",
+	"COPY",
+	"COMPRESS",
+	"DECOMPRESS",
+	"ARCHIVE_LIST",
+	"ARCHIVE_READ",
+	"UPLOAD_INIT",
+	"UPLOAD_CHUNK",
+	"UPLOAD_FINISH",
+	"UPLOAD_STATUS",
+	"UPLOAD_ABORT",
+	"DOWNLOAD_INIT",
+	"DOWNLOAD_CHUNK",
+	"DOWNLOAD_ABORT",
+	"FETCH_URL",
+	"EXPLAIN",
+	"AUDIT_QUERY",
+}
+
+func IsAction(name string) bool {
+	for _, a := range Actions {
+		if a == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package ws
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	"minebot-agent/internal/audit"
+	"minebot-agent/internal/config"
+	"minebot-agent/internal/protocol"
+)
+
+// Chunk transfers are covered by their INIT and FINISH entries.
+var auditSkip = map[string]bool{
+	"UPLOAD_CHUNK":   true,
+	"DOWNLOAD_CHUNK": true,
+}
+
+func openAudit(cfg config.AuditConfig) *audit.Log {
+	if cfg.Disabled {
+		return nil
+	}
+	l, err := audit.Open(cfg.Path, int64(cfg.MaxSizeMB)*1024*1024, cfg.MaxFiles)
+	if err != nil {
+		log.Printf("audit log disabled: %v", err)
+		return nil
+	}
+	return l
+}
+
+func (h *Handlers) record(msg protocol.Message, resp protocol.Message, took time.Duration) {
+	if auditSkip[msg.Action] {
+		return
+	}
+	h.cfgMu.RLock()
+	defer h.cfgMu.RUnlock()
+	if h.audit == nil {
+		return
+	}
+	var payload struct {
+		Command string   `json:"command"`
+		Argv    []string `json:"argv"`
+	}
+	_ = json.Unmarshal(msg.Payload, &payload)
+	var result protocol.ResponsePayload
+	_ = json.Unmarshal(resp.Payload, &result)
+
+	req := policyRequest(msg)
+	cmd := payload.Command
+	if len(payload.Argv) > 0 {
+		cmd = strings.Join(payload.Argv, " ")
+	}
+	message := ""
+	if !result.Success {
+		message = result.Message
+	}
+	err := h.audit.Append(audit.Entry{
+		RequestID:  msg.ID,
+		Action:     msg.Action,
+		ServerID:   req.ServerID,
+		Scope:      msg.Scope,
+		Paths:      req.Paths,
+		Command:    cmd,
+		Success:    result.Success,
+		Message:    message,
+		DurationMs: took.Milliseconds(),
+	})
+	if err != nil {
+		log.Printf("audit write failed: %v", err)
+	}
+}
+
+func (h *request) handleAuditQuery(msg protocol.Message) protocol.Message {
+	var payload struct {
+		Action   string `json:"action"`
+		ServerID string `json:"serverId"`
+		Offset   int    `json:"offset"`
+		Limit    int    `json:"limit"`
+	}
+	_ = json.Unmarshal(msg.Payload, &payload)
+	// SetConfig may close and replace the log. Query only reads the files,
+	// so the scan can run on the old log without holding up a reload.
+	h.cfgMu.RLock()
+	auditLog := h.audit
+	h.cfgMu.RUnlock()
+	if auditLog == nil {
+		return response(msg.ID, false, "audit log disabled", nil)
+	}
+	if payload.Limit <= 0 || payload.Limit > 500 {
+		payload.Limit = 100
+	}
+	if payload.Offset < 0 {
+		payload.Offset = 0
+	}
+	page, err := auditLog.Query(audit.Filter{
+		Action:   payload.Action,
+		ServerID: payload.ServerID,
+		Servers:  h.scopeServers(msg.Scope),
+		Offset:   payload.Offset,
+		Limit:    payload.Limit,
+	})
+	if err != nil {
+		return response(msg.ID, false, err.Error(), nil)
+	}
+	return response(msg.ID, true, "ok", page)
+}
@@ -18,22 +18,25 @@ import (
 )
 
 type Client struct {
-	cfg      *config.Config
-	conn     *websocket.Conn
-	mu       sync.Mutex
-	closed   bool
-	handlers *Handlers
+	cfg         *config.Config
+	conn        *websocket.Conn
+	mu          sync.Mutex
+	closed      bool
+	handlers    *Handlers
+	maintenance bool
 }
 
 func NewClient(cfg *config.Config) *Client {
-	return &Client{
+	c := &Client{
 		cfg:      cfg,
 		handlers: NewHandlers(cfg),
 	}
+	c.handlers.SetEventSink(func(msg protocol.Message) { _ = c.send(msg) })
+	return c
 }
 
 func (c *Client) Connect() error {
-	u, err := url.Parse(c.cfg.WSURL)
+	u, err := url.Parse(c.config().WSURL)
 	if err != nil {
 		return err
 	}
@@ -48,6 +51,7 @@ func (c *Client) Connect() error {
 }
 
 func (c *Client) Run() {
+	go c.handlers.SweepTransfers()
 	go c.readLoop()
 	c.heartbeatLoop()
 }
@@ -73,6 +77,13 @@ func (c *Client) readLoop() {
 		case "PING":
 			c.send(protocol.Message{Type: "PONG", Ts: time.Now().Unix()})
 		case "REQ":
+			if msg.Action == "UPLOAD_CHUNK" || msg.Action == "DOWNLOAD_CHUNK" || msg.Action == "DOWNLOAD_INIT" {
+				// chunks are independent; let several be in flight at once.
+				// DOWNLOAD_INIT hashes the whole file, so it must not hold
+				// up the read loop either.
+				go func(msg protocol.Message) { c.send(c.handlers.Handle(msg)) }(msg)
+				continue
+			}
 			resp := c.handlers.Handle(msg)
 			c.send(resp)
 		}
@@ -87,20 +98,78 @@ func (c *Client) heartbeatLoop() {
 			return
 		}
 		c.send(protocol.Message{Type: "PING", Ts: time.Now().Unix()})
+		c.NotifyMaintenance()
 	}
 }
 
+// SetMaintenance toggles the runtime maintenance override and tells the
+// panel right away.
+func (c *Client) SetMaintenance(on bool) {
+	c.handlers.SetMaintenance(on)
+	c.NotifyMaintenance()
+}
+
+// NotifyMaintenance sends a MAINTENANCE event if the effective state changed
+// since the last AUTH or event.
+func (c *Client) NotifyMaintenance() {
+	caps := c.handlers.Capabilities()
+	on := caps["maintenance"].(bool)
+	c.mu.Lock()
+	changed := on != c.maintenance
+	c.maintenance = on
+	c.mu.Unlock()
+	if !changed {
+		return
+	}
+	log.Printf("maintenance mode: %v", on)
+	b, _ := json.Marshal(caps)
+	c.send(protocol.Message{Type: "EVENT", Action: "MAINTENANCE", Payload: b, Ts: time.Now().Unix()})
+}
+
+// Reload applies cfg to the handlers and reconnects only when the
+// connection settings changed.
+func (c *Client) Reload(cfg *config.Config) {
+	c.handlers.SetConfig(cfg)
+
+	c.mu.Lock()
+	same := c.cfg.SameConnection(cfg)
+	c.cfg = cfg
+	conn := c.conn
+	c.mu.Unlock()
+
+	if !same && conn != nil {
+		log.Printf("connection settings changed, reconnecting")
+		_ = conn.Close()
+		return
+	}
+	c.NotifyMaintenance()
+}
+
+func (c *Client) config() *config.Config {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cfg
+}
+
 func (c *Client) sendAuth() error {
+	cfg := c.config()
 	nonce := uuid.NewString()
 	ts := time.Now().Unix()
-	payload := c.cfg.AgentID + nonce + strconv.FormatInt(ts, 10)
-	sig := auth.Sign(c.cfg.Token, payload)
+	payload := cfg.AgentID + nonce + strconv.FormatInt(ts, 10)
+	sig := auth.Sign(cfg.Token, payload)
+
+	caps := c.handlers.Capabilities()
+	c.mu.Lock()
+	c.maintenance = caps["maintenance"].(bool)
+	c.mu.Unlock()
 
 	body := map[string]interface{}{
-		"agentId": c.cfg.AgentID,
-		"nonce":   nonce,
-		"ts":      ts,
-		"sig":     sig,
+		"agentId":      cfg.AgentID,
+		"nonce":        nonce,
+		"ts":           ts,
+		"sig":          sig,
+		"maintenance":  caps["maintenance"],
+		"capabilities": caps,
 	}
 	b, _ := json.Marshal(body)
 
@@ -0,0 +1,171 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"minebot-agent/internal/config"
+	"minebot-agent/internal/fetch"
+	"minebot-agent/internal/fsops"
+	"minebot-agent/internal/protocol"
+)
+
+const (
+	defaultFetchMaxBytes     = 512 << 20
+	defaultFetchMaxRedirects = 5
+	defaultFetchTimeout      = 10 * time.Minute
+)
+
+// fetchJob is a FETCH_URL download running in the background.
+type fetchJob struct {
+	cancel context.CancelFunc
+	once   sync.Once
+	staged *fsops.StagedFile
+}
+
+func (j *fetchJob) TempPath() string { return j.staged.TempPath() }
+
+func (j *fetchJob) Abort() error {
+	j.once.Do(j.cancel)
+	return nil
+}
+
+func fetchSettings(cfg config.FetchConfig) (maxBytes int64, maxRedirects int, timeout time.Duration) {
+	maxBytes, maxRedirects, timeout = defaultFetchMaxBytes, defaultFetchMaxRedirects, defaultFetchTimeout
+	if cfg.MaxBytes > 0 {
+		maxBytes = cfg.MaxBytes
+	}
+	if cfg.MaxRedirects > 0 {
+		maxRedirects = cfg.MaxRedirects
+	}
+	if cfg.TimeoutSec > 0 {
+		timeout = time.Duration(cfg.TimeoutSec) * time.Second
+	}
+	return maxBytes, maxRedirects, timeout
+}
+
+// handleFetchURL validates the request and starts the download. Progress
+// and the outcome are reported as FETCH_PROGRESS and FETCH_DONE events.
+func (h *request) handleFetchURL(msg protocol.Message) protocol.Message {
+	var payload struct {
+		ServerID  string `json:"serverId"`
+		URL       string `json:"url"`
+		Path      string `json:"path"`
+		SHA256    string `json:"sha256"`
+		SHA1      string `json:"sha1"`
+		MaxBytes  int64  `json:"maxBytes"`
+		Mode      string `json:"mode"`
+		Overwrite *bool  `json:"overwrite"`
+	}
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		return response(msg.ID, false, "bad payload", nil)
+	}
+	cfg := h.cfg.Fetch
+	if len(cfg.AllowHosts) == 0 {
+		return response(msg.ID, false, "fetch.allowHosts is empty; FETCH_URL is disabled", nil)
+	}
+	if _, err := fetch.CheckURL(payload.URL, cfg.AllowHosts); err != nil {
+		return response(msg.ID, false, err.Error(), nil)
+	}
+	if err := fetch.CheckDigests(payload.SHA256, payload.SHA1); err != nil {
+		return response(msg.ID, false, err.Error(), nil)
+	}
+	maxBytes, maxRedirects, timeout := fetchSettings(cfg)
+	if payload.MaxBytes > 0 && payload.MaxBytes < maxBytes {
+		maxBytes = payload.MaxBytes
+	}
+
+	base, err := h.resolveBase(payload.ServerID)
+	if err != nil {
+		return response(msg.ID, false, err.Error(), nil)
+	}
+	staged, err := fsops.NewStagedFile(base, payload.Path, fsops.UploadOptions{
+		Mode:      payload.Mode,
+		Overwrite: payload.Overwrite == nil || *payload.Overwrite,
+	})
+	if err != nil {
+		return response(msg.ID, false, err.Error(), nil)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	job := &fetchJob{cancel: cancel, staged: staged}
+	_, maxUploads, _ := transferSettings(h.cfg.Transfers)
+	fetchID, err := h.fetches.add(payload.ServerID, msg.Scope, job, maxUploads)
+	if err != nil {
+		cancel()
+		_ = staged.Abort()
+		return response(msg.ID, false, err.Error(), nil)
+	}
+
+	opts := fetch.Options{
+		URL:          payload.URL,
+		AllowHosts:   cfg.AllowHosts,
+		MaxBytes:     maxBytes,
+		MaxRedirects: maxRedirects,
+		SHA256:       payload.SHA256,
+		SHA1:         payload.SHA1,
+		Progress: func(received, total int64) {
+			h.emit("FETCH_PROGRESS", map[string]interface{}{
+				"fetchId":  fetchID,
+				"serverId": payload.ServerID,
+				"path":     staged.Path(),
+				"received": received,
+				"total":    total,
+			})
+		},
+	}
+	go func() {
+		defer h.fetches.remove(fetchID)
+		defer job.Abort()
+		start := time.Now()
+		result, err := fetch.Fetch(ctx, opts, staged)
+		if err == nil {
+			err = staged.Commit()
+		}
+		if err != nil {
+			_ = staged.Abort()
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				err = errors.New("fetch timed out")
+			}
+		}
+		done := map[string]interface{}{
+			"fetchId":  fetchID,
+			"serverId": payload.ServerID,
+			"path":     staged.Path(),
+			"success":  err == nil,
+		}
+		var res protocol.Message
+		if err != nil {
+			log.Printf("fetch %s failed: %v", fetchID, err)
+			done["message"] = err.Error()
+			res = response(msg.ID, false, err.Error(), nil)
+		} else {
+			done["result"] = result
+			res = response(msg.ID, true, "ok", result)
+		}
+		h.emit("FETCH_DONE", done)
+		h.record(msg, res, time.Since(start))
+	}()
+	return response(msg.ID, true, "started", map[string]string{"fetchId": fetchID, "path": staged.Path()})
+}
+
+// SetEventSink sets where handlers send asynchronous events.
+func (h *Handlers) SetEventSink(send func(protocol.Message)) {
+	h.eventsMu.Lock()
+	h.events = send
+	h.eventsMu.Unlock()
+}
+
+func (h *Handlers) emit(action string, payload interface{}) {
+	h.eventsMu.Lock()
+	send := h.events
+	h.eventsMu.Unlock()
+	if send == nil {
+		return
+	}
+	b, _ := json.Marshal(payload)
+	send(protocol.Message{Type: "EVENT", Action: action, Payload: b, Ts: time.Now().Unix()})
+}
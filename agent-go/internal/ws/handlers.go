@@ -1,37 +1,132 @@
 package ws
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/google/uuid"
-
+	"minebot-agent/internal/audit"
+	"minebot-agent/internal/command"
 	"minebot-agent/internal/config"
 	"minebot-agent/internal/dockerexec"
 	"minebot-agent/internal/fsops"
+	"minebot-agent/internal/policy"
 	"minebot-agent/internal/protocol"
 	"minebot-agent/internal/rcon"
 	"minebot-agent/internal/stats"
 )
 
+// archivePreviewBytes caps how much of an entry ARCHIVE_READ returns.
+const archivePreviewBytes = 1 << 20
+
 type Handlers struct {
-	cfg     *config.Config
-	uploads map[string]*fsops.UploadSession
+	cfgMu       sync.RWMutex
+	cfg         *config.Config
+	policy      *policy.Engine
+	uploads     *transferTable
+	downloads   *transferTable
+	fetches     *transferTable
+	idempotency *idempotencyCache
+	audit       *audit.Log
+
+	maintenanceSignal atomic.Bool
+
+	eventsMu sync.Mutex
+	events   func(protocol.Message)
 }
 
 func NewHandlers(cfg *config.Config) *Handlers {
 	return &Handlers{
-		cfg:     cfg,
-		uploads: map[string]*fsops.UploadSession{},
+		cfg:         cfg,
+		policy:      policy.New(cfg.Policy),
+		uploads:     newTransferTable("upload"),
+		downloads:   newTransferTable("download"),
+		fetches:     newTransferTable("fetch"),
+		idempotency: newIdempotencyCache(idempotencyCapacity, idempotencyTTL),
+		audit:       openAudit(cfg.Audit),
 	}
 }
 
+// SetConfig swaps the configuration used for subsequent requests. Requests
+// already running finish with the config they started with.
+func (h *Handlers) SetConfig(cfg *config.Config) {
+	h.cfgMu.Lock()
+	if cfg.Audit != h.cfg.Audit {
+		if h.audit != nil {
+			_ = h.audit.Close()
+		}
+		h.audit = openAudit(cfg.Audit)
+	}
+	h.cfg = cfg
+	h.policy = policy.New(cfg.Policy)
+	h.cfgMu.Unlock()
+}
+
+// request is what one request runs with: the handlers plus the config and
+// policy that were current when it arrived. The lock is only held while the
+// snapshot is taken, so a reload never waits for a slow COPY or DECOMPRESS.
+type request struct {
+	*Handlers
+	cfg    *config.Config
+	policy *policy.Engine
+}
+
+func (h *Handlers) snapshot() *request {
+	h.cfgMu.RLock()
+	defer h.cfgMu.RUnlock()
+	return &request{Handlers: h, cfg: h.cfg, policy: h.policy}
+}
+
 func (h *Handlers) Handle(msg protocol.Message) protocol.Message {
-	if !h.isActionAllowed(msg.Action) {
+	start := time.Now()
+	resp := h.snapshot().handle(msg)
+	h.record(msg, resp, time.Since(start))
+	return resp
+}
+
+func (h *request) handle(msg protocol.Message) protocol.Message {
+	if err := h.checkScope(msg); err != nil {
+		return response(msg.ID, false, err.Error(), nil)
+	}
+	if err := h.checkServer(msg); err != nil {
+		return response(msg.ID, false, err.Error(), nil)
+	}
+	if !h.isActionAllowed(msg) {
 		return response(msg.ID, false, "action not allowed", nil)
 	}
+	if d := h.checkPolicy(msg); !d.Allowed {
+		return response(msg.ID, false, "policy: "+d.Reason, nil)
+	}
+	if !readOnlyActions[msg.Action] && h.inMaintenance() {
+		return responseCode(msg.ID, codeMaintenance, "agent is in maintenance mode")
+	}
 
+	key := idempotencyKey(msg)
+	var sum [sha256.Size]byte
+	if key != "" {
+		sum = requestHash(msg.Payload)
+		payload, ok, err := h.idempotency.get(key, sum)
+		if err != nil {
+			return response(msg.ID, false, err.Error(), nil)
+		}
+		if ok {
+			return protocol.Message{Type: "RES", ID: msg.ID, Payload: payload, Ts: time.Now().Unix()}
+		}
+	}
+	resp := h.dispatch(msg)
+	if key != "" {
+		h.idempotency.put(key, sum, resp.Payload)
+	}
+	return resp
+}
+
+func (h *request) dispatch(msg protocol.Message) protocol.Message {
 	switch msg.Action {
 	case "START":
 		return h.handlePower(msg, "start")
@@ -43,6 +138,8 @@ func (h *Handlers) Handle(msg protocol.Message) protocol.Message {
 		return h.handlePower(msg, "kill")
 	case "COMMAND":
 		return h.handleCommand(msg)
+	case "EXEC":
+		return h.handleExec(msg)
 	case "STATS":
 		return h.handleStats(msg)
 	case "HOST_STATS":
@@ -71,24 +168,41 @@ func (h *Handlers) Handle(msg protocol.Message) protocol.Message {
 		return h.handleCompress(msg)
 	case "DECOMPRESS":
 		return h.handleDecompress(msg)
+	case "ARCHIVE_LIST":
+		return h.handleArchiveList(msg)
+	case "ARCHIVE_READ":
+		return h.handleArchiveRead(msg)
 	case "UPLOAD_INIT":
 		return h.handleUploadInit(msg)
 	case "UPLOAD_CHUNK":
 		return h.handleUploadChunk(msg)
 	case "UPLOAD_FINISH":
 		return h.handleUploadFinish(msg)
+	case "UPLOAD_STATUS":
+		return h.handleUploadStatus(msg)
+	case "UPLOAD_ABORT":
+		return h.handleUploadAbort(msg)
 	case "DOWNLOAD_INIT":
 		return h.handleDownloadInit(msg)
 	case "DOWNLOAD_CHUNK":
 		return h.handleDownloadChunk(msg)
+	case "DOWNLOAD_ABORT":
+		return h.handleDownloadAbort(msg)
+	case "FETCH_URL":
+		return h.handleFetchURL(msg)
+	case "EXPLAIN":
+		return h.handleExplain(msg)
+	case "AUDIT_QUERY":
+		return h.handleAuditQuery(msg)
 	default:
 		return response(msg.ID, false, "unknown action", nil)
 	}
 }
 
-func (h *Handlers) handlePower(msg protocol.Message, op string) protocol.Message {
+func (h *request) handlePower(msg protocol.Message, op string) protocol.Message {
 	var payload struct {
 		ServerID string `json:"serverId"`
+		DryRun   bool   `json:"dryRun"`
 	}
 	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
 		return response(msg.ID, false, "bad payload", nil)
@@ -97,6 +211,9 @@ func (h *Handlers) handlePower(msg protocol.Message, op string) protocol.Message
 	if container == "" {
 		return response(msg.ID, false, "container not found", nil)
 	}
+	if payload.DryRun {
+		return response(msg.ID, true, "dry run", map[string]string{"container": container, "op": op})
+	}
 	err := dockerexec.Power(h.cfg.DockerBin, op, container)
 	if err != nil {
 		return response(msg.ID, false, err.Error(), nil)
@@ -104,7 +221,7 @@ func (h *Handlers) handlePower(msg protocol.Message, op string) protocol.Message
 	return response(msg.ID, true, "ok", nil)
 }
 
-func (h *Handlers) handleCommand(msg protocol.Message) protocol.Message {
+func (h *request) handleCommand(msg protocol.Message) protocol.Message {
 	var payload struct {
 		ServerID string `json:"serverId"`
 		Command  string `json:"command"`
@@ -112,26 +229,84 @@ func (h *Handlers) handleCommand(msg protocol.Message) protocol.Message {
 	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
 		return response(msg.ID, false, "bad payload", nil)
 	}
-	if !h.isCommandAllowed(payload.Command) {
-		return response(msg.ID, false, "command not allowed", nil)
+	srv := h.cfg.Server(payload.ServerID)
+	if err := command.Check(srv.CommandRules, h.cfg.Security.CommandRules, srv.CommandAllowlist, payload.Command); err != nil {
+		return response(msg.ID, false, err.Error(), nil)
 	}
-	if h.cfg.Rcon.Enabled {
-		if out, err := rcon.Exec(h.cfg.Rcon, payload.Command); err == nil {
+	useRcon := srv.Rcon.Enabled && srv.ConsoleInput != config.ConsoleInputExec
+	if useRcon {
+		out, err := rcon.Exec(*srv.Rcon, payload.Command)
+		if err == nil {
 			return response(msg.ID, true, out, nil)
 		}
+		if srv.ConsoleInput == config.ConsoleInputRcon {
+			return response(msg.ID, false, err.Error(), nil)
+		}
+	} else if srv.ConsoleInput == config.ConsoleInputRcon {
+		return response(msg.ID, false, "rcon not enabled", nil)
 	}
 	container := h.resolveContainer(payload.ServerID)
 	if container == "" {
 		return response(msg.ID, false, "container not found", nil)
 	}
-	out, err := dockerexec.Exec(h.cfg.DockerBin, container, payload.Command)
+	out, err := h.execCommand(srv, container, payload.Command)
 	if err != nil {
 		return response(msg.ID, false, err.Error(), nil)
 	}
 	return response(msg.ID, true, out, nil)
 }
 
-func (h *Handlers) handleStats(msg protocol.Message) protocol.Message {
+func (h *request) handleExec(msg protocol.Message) protocol.Message {
+	var payload struct {
+		ServerID string   `json:"serverId"`
+		Argv     []string `json:"argv"`
+		Command  string   `json:"command"`
+	}
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		return response(msg.ID, false, "bad payload", nil)
+	}
+	srv := h.cfg.Server(payload.ServerID)
+	if !srv.AllowExec {
+		return response(msg.ID, false, "exec is not enabled for this server", nil)
+	}
+	argv := payload.Argv
+	switch {
+	case len(argv) > 0:
+	case payload.Command == "":
+		return response(msg.ID, false, "missing argv or command", nil)
+	case srv.ExecShell:
+		argv = dockerexec.ShellArgv(payload.Command)
+	default:
+		var err error
+		if argv, err = dockerexec.SplitArgs(payload.Command); err != nil {
+			return response(msg.ID, false, err.Error(), nil)
+		}
+	}
+	if len(argv) > 0 && dockerexec.IsShell(argv[0]) && !srv.ExecShell {
+		return response(msg.ID, false, "running a shell requires execShell", nil)
+	}
+	if err := command.CheckExec(srv.ExecRules, h.cfg.Security.ExecRules, argv); err != nil {
+		return response(msg.ID, false, err.Error(), nil)
+	}
+	container := h.resolveContainer(payload.ServerID)
+	if container == "" {
+		return response(msg.ID, false, "container not found", nil)
+	}
+	out, err := dockerexec.ExecArgv(h.cfg.DockerBin, container, argv)
+	if err != nil {
+		return response(msg.ID, false, err.Error(), nil)
+	}
+	return response(msg.ID, true, out, nil)
+}
+
+func (h *request) execCommand(srv config.ServerConfig, container, command string) (string, error) {
+	if srv.ExecShell {
+		return dockerexec.ExecShell(h.cfg.DockerBin, container, command)
+	}
+	return dockerexec.Exec(h.cfg.DockerBin, container, command)
+}
+
+func (h *request) handleStats(msg protocol.Message) protocol.Message {
 	var payload struct {
 		ServerID string `json:"serverId"`
 	}
@@ -149,7 +324,7 @@ func (h *Handlers) handleStats(msg protocol.Message) protocol.Message {
 	return response(msg.ID, true, "ok", data)
 }
 
-func (h *Handlers) handleHostStats(msg protocol.Message) protocol.Message {
+func (h *request) handleHostStats(msg protocol.Message) protocol.Message {
 	data, err := stats.GetHost(h.cfg.FileRoot)
 	if err != nil {
 		return response(msg.ID, false, err.Error(), nil)
@@ -157,7 +332,7 @@ func (h *Handlers) handleHostStats(msg protocol.Message) protocol.Message {
 	return response(msg.ID, true, "ok", data)
 }
 
-func (h *Handlers) handleProcessList(msg protocol.Message) protocol.Message {
+func (h *request) handleProcessList(msg protocol.Message) protocol.Message {
 	var payload struct {
 		Limit int `json:"limit"`
 	}
@@ -172,7 +347,7 @@ func (h *Handlers) handleProcessList(msg protocol.Message) protocol.Message {
 	return response(msg.ID, true, "ok", list)
 }
 
-func (h *Handlers) handleLogs(msg protocol.Message) protocol.Message {
+func (h *request) handleLogs(msg protocol.Message) protocol.Message {
 	var payload struct {
 		ServerID string `json:"serverId"`
 		Tail     int    `json:"tail"`
@@ -191,7 +366,7 @@ func (h *Handlers) handleLogs(msg protocol.Message) protocol.Message {
 	return response(msg.ID, true, "ok", map[string]string{"logs": data})
 }
 
-func (h *Handlers) handleList(msg protocol.Message) protocol.Message {
+func (h *request) handleList(msg protocol.Message) protocol.Message {
 	var payload struct {
 		ServerID string `json:"serverId"`
 		Path     string `json:"path"`
@@ -199,7 +374,10 @@ func (h *Handlers) handleList(msg protocol.Message) protocol.Message {
 	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
 		return response(msg.ID, false, "bad payload", nil)
 	}
-	base := fsops.ResolveBase(h.cfg.FileRoot, h.cfg.VolumeMap, h.cfg.ContainerMap, payload.ServerID)
+	base, err := h.resolveBase(payload.ServerID)
+	if err != nil {
+		return response(msg.ID, false, err.Error(), nil)
+	}
 	items, err := fsops.List(base, payload.Path)
 	if err != nil {
 		return response(msg.ID, false, err.Error(), nil)
@@ -207,7 +385,7 @@ func (h *Handlers) handleList(msg protocol.Message) protocol.Message {
 	return response(msg.ID, true, "ok", items)
 }
 
-func (h *Handlers) handleRead(msg protocol.Message) protocol.Message {
+func (h *request) handleRead(msg protocol.Message) protocol.Message {
 	var payload struct {
 		ServerID string `json:"serverId"`
 		Path     string `json:"path"`
@@ -215,7 +393,10 @@ func (h *Handlers) handleRead(msg protocol.Message) protocol.Message {
 	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
 		return response(msg.ID, false, "bad payload", nil)
 	}
-	base := fsops.ResolveBase(h.cfg.FileRoot, h.cfg.VolumeMap, h.cfg.ContainerMap, payload.ServerID)
+	base, err := h.resolveBase(payload.ServerID)
+	if err != nil {
+		return response(msg.ID, false, err.Error(), nil)
+	}
 	content, err := fsops.Read(base, payload.Path)
 	if err != nil {
 		return response(msg.ID, false, err.Error(), nil)
@@ -223,7 +404,7 @@ func (h *Handlers) handleRead(msg protocol.Message) protocol.Message {
 	return response(msg.ID, true, "ok", map[string]string{"content": content})
 }
 
-func (h *Handlers) handleWrite(msg protocol.Message) protocol.Message {
+func (h *request) handleWrite(msg protocol.Message) protocol.Message {
 	var payload struct {
 		ServerID string `json:"serverId"`
 		Path     string `json:"path"`
@@ -232,14 +413,17 @@ func (h *Handlers) handleWrite(msg protocol.Message) protocol.Message {
 	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
 		return response(msg.ID, false, "bad payload", nil)
 	}
-	base := fsops.ResolveBase(h.cfg.FileRoot, h.cfg.VolumeMap, h.cfg.ContainerMap, payload.ServerID)
+	base, err := h.resolveBase(payload.ServerID)
+	if err != nil {
+		return response(msg.ID, false, err.Error(), nil)
+	}
 	if err := fsops.Write(base, payload.Path, payload.Content); err != nil {
 		return response(msg.ID, false, err.Error(), nil)
 	}
 	return response(msg.ID, true, "ok", nil)
 }
 
-func (h *Handlers) handleMkdir(msg protocol.Message) protocol.Message {
+func (h *request) handleMkdir(msg protocol.Message) protocol.Message {
 	var payload struct {
 		ServerID string `json:"serverId"`
 		Root     string `json:"root"`
@@ -248,14 +432,17 @@ func (h *Handlers) handleMkdir(msg protocol.Message) protocol.Message {
 	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
 		return response(msg.ID, false, "bad payload", nil)
 	}
-	base := fsops.ResolveBase(h.cfg.FileRoot, h.cfg.VolumeMap, h.cfg.ContainerMap, payload.ServerID)
+	base, err := h.resolveBase(payload.ServerID)
+	if err != nil {
+		return response(msg.ID, false, err.Error(), nil)
+	}
 	if err := fsops.Mkdir(base, payload.Root, payload.Name); err != nil {
 		return response(msg.ID, false, err.Error(), nil)
 	}
 	return response(msg.ID, true, "ok", nil)
 }
 
-func (h *Handlers) handleChmod(msg protocol.Message) protocol.Message {
+func (h *request) handleChmod(msg protocol.Message) protocol.Message {
 	var payload struct {
 		ServerID string `json:"serverId"`
 		Path     string `json:"path"`
@@ -267,123 +454,253 @@ func (h *Handlers) handleChmod(msg protocol.Message) protocol.Message {
 	if payload.Path == "" || payload.Mode == "" {
 		return response(msg.ID, false, "missing path or mode", nil)
 	}
-	base := fsops.ResolveBase(h.cfg.FileRoot, h.cfg.VolumeMap, h.cfg.ContainerMap, payload.ServerID)
+	base, err := h.resolveBase(payload.ServerID)
+	if err != nil {
+		return response(msg.ID, false, err.Error(), nil)
+	}
 	if err := fsops.Chmod(base, payload.Path, payload.Mode); err != nil {
 		return response(msg.ID, false, err.Error(), nil)
 	}
 	return response(msg.ID, true, "ok", nil)
 }
 
-func (h *Handlers) handleDelete(msg protocol.Message) protocol.Message {
+func (h *request) handleDelete(msg protocol.Message) protocol.Message {
 	var payload struct {
 		ServerID string   `json:"serverId"`
 		Root     string   `json:"root"`
 		Files    []string `json:"files"`
+		DryRun   bool     `json:"dryRun"`
 	}
 	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
 		return response(msg.ID, false, "bad payload", nil)
 	}
-	base := fsops.ResolveBase(h.cfg.FileRoot, h.cfg.VolumeMap, h.cfg.ContainerMap, payload.ServerID)
+	base, err := h.resolveBase(payload.ServerID)
+	if err != nil {
+		return response(msg.ID, false, err.Error(), nil)
+	}
+	if payload.DryRun {
+		plan, err := fsops.PlanDelete(base, payload.Root, payload.Files)
+		if err != nil {
+			return response(msg.ID, false, err.Error(), nil)
+		}
+		return response(msg.ID, true, "dry run", plan)
+	}
 	if err := fsops.Delete(base, payload.Root, payload.Files); err != nil {
 		return response(msg.ID, false, err.Error(), nil)
 	}
 	return response(msg.ID, true, "ok", nil)
 }
 
-func (h *Handlers) handleRename(msg protocol.Message) protocol.Message {
+func (h *request) handleRename(msg protocol.Message) protocol.Message {
 	var payload struct {
 		ServerID string `json:"serverId"`
 		Root     string `json:"root"`
 		From     string `json:"from"`
 		To       string `json:"to"`
+		DryRun   bool   `json:"dryRun"`
 	}
 	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
 		return response(msg.ID, false, "bad payload", nil)
 	}
-	base := fsops.ResolveBase(h.cfg.FileRoot, h.cfg.VolumeMap, h.cfg.ContainerMap, payload.ServerID)
+	base, err := h.resolveBase(payload.ServerID)
+	if err != nil {
+		return response(msg.ID, false, err.Error(), nil)
+	}
+	if payload.DryRun {
+		plan, err := fsops.PlanRename(base, payload.Root, payload.From, payload.To)
+		if err != nil {
+			return response(msg.ID, false, err.Error(), nil)
+		}
+		return response(msg.ID, true, "dry run", plan)
+	}
 	if err := fsops.Rename(base, payload.Root, payload.From, payload.To); err != nil {
 		return response(msg.ID, false, err.Error(), nil)
 	}
 	return response(msg.ID, true, "ok", nil)
 }
 
-func (h *Handlers) handleCopy(msg protocol.Message) protocol.Message {
+func (h *request) handleCopy(msg protocol.Message) protocol.Message {
 	var payload struct {
-		ServerID string `json:"serverId"`
-		Location string `json:"location"`
+		ServerID      string `json:"serverId"`
+		Location      string `json:"location"`
+		PreserveOwner bool   `json:"preserveOwner"`
 	}
 	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
 		return response(msg.ID, false, "bad payload", nil)
 	}
-	base := fsops.ResolveBase(h.cfg.FileRoot, h.cfg.VolumeMap, h.cfg.ContainerMap, payload.ServerID)
-	if err := fsops.Copy(base, payload.Location); err != nil {
+	base, err := h.resolveBase(payload.ServerID)
+	if err != nil {
+		return response(msg.ID, false, err.Error(), nil)
+	}
+	if err := fsops.Copy(base, payload.Location, payload.PreserveOwner); err != nil {
 		return response(msg.ID, false, err.Error(), nil)
 	}
 	return response(msg.ID, true, "ok", nil)
 }
 
-func (h *Handlers) handleCompress(msg protocol.Message) protocol.Message {
+func (h *request) handleCompress(msg protocol.Message) protocol.Message {
 	var payload struct {
 		ServerID string   `json:"serverId"`
 		Root     string   `json:"root"`
 		Files    []string `json:"files"`
+		Format   string   `json:"format"`
+		Name     string   `json:"name"`
 	}
 	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
 		return response(msg.ID, false, "bad payload", nil)
 	}
-	base := fsops.ResolveBase(h.cfg.FileRoot, h.cfg.VolumeMap, h.cfg.ContainerMap, payload.ServerID)
-	archive, err := fsops.Compress(base, payload.Root, payload.Files)
+	base, err := h.resolveBase(payload.ServerID)
+	if err != nil {
+		return response(msg.ID, false, err.Error(), nil)
+	}
+	archive, err := fsops.Compress(base, payload.Root, payload.Files, payload.Format, payload.Name)
 	if err != nil {
 		return response(msg.ID, false, err.Error(), nil)
 	}
 	return response(msg.ID, true, "ok", map[string]string{"archive": archive})
 }
 
-func (h *Handlers) handleDecompress(msg protocol.Message) protocol.Message {
+func (h *request) handleDecompress(msg protocol.Message) protocol.Message {
+	var payload struct {
+		ServerID      string   `json:"serverId"`
+		Root          string   `json:"root"`
+		File          string   `json:"file"`
+		Destination   string   `json:"destination"`
+		Conflict      string   `json:"conflict"`
+		Entries       []string `json:"entries"`
+		DryRun        bool     `json:"dryRun"`
+		PreserveOwner bool     `json:"preserveOwner"`
+	}
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		return response(msg.ID, false, "bad payload", nil)
+	}
+	base, err := h.resolveBase(payload.ServerID)
+	if err != nil {
+		return response(msg.ID, false, err.Error(), nil)
+	}
+	opts := fsops.ExtractOptions{
+		Limits:        h.extractLimits(),
+		PreserveOwner: payload.PreserveOwner,
+		Conflict:      payload.Conflict,
+		Entries:       payload.Entries,
+	}
+	if payload.DryRun {
+		plan, err := fsops.PlanDecompress(base, payload.Root, payload.File, payload.Destination, opts)
+		if err != nil {
+			return response(msg.ID, false, err.Error(), nil)
+		}
+		return response(msg.ID, true, "dry run", plan)
+	}
+	if err := fsops.Decompress(base, payload.Root, payload.File, payload.Destination, opts); err != nil {
+		return response(msg.ID, false, err.Error(), nil)
+	}
+	return response(msg.ID, true, "ok", nil)
+}
+
+func (h *request) handleArchiveList(msg protocol.Message) protocol.Message {
+	var payload struct {
+		ServerID string `json:"serverId"`
+		Root     string `json:"root"`
+		File     string `json:"file"`
+		Offset   int    `json:"offset"`
+		Limit    int    `json:"limit"`
+	}
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		return response(msg.ID, false, "bad payload", nil)
+	}
+	if payload.Limit <= 0 || payload.Limit > 1000 {
+		payload.Limit = 100
+	}
+	if payload.Offset < 0 {
+		payload.Offset = 0
+	}
+	base, err := h.resolveBase(payload.ServerID)
+	if err != nil {
+		return response(msg.ID, false, err.Error(), nil)
+	}
+	listing, err := fsops.ListArchive(base, payload.Root, payload.File, payload.Offset, payload.Limit)
+	if err != nil {
+		return response(msg.ID, false, err.Error(), nil)
+	}
+	return response(msg.ID, true, "ok", listing)
+}
+
+func (h *request) handleArchiveRead(msg protocol.Message) protocol.Message {
 	var payload struct {
 		ServerID string `json:"serverId"`
 		Root     string `json:"root"`
 		File     string `json:"file"`
+		Entry    string `json:"entry"`
 	}
 	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
 		return response(msg.ID, false, "bad payload", nil)
 	}
-	base := fsops.ResolveBase(h.cfg.FileRoot, h.cfg.VolumeMap, h.cfg.ContainerMap, payload.ServerID)
-	if err := fsops.Decompress(base, payload.Root, payload.File); err != nil {
+	base, err := h.resolveBase(payload.ServerID)
+	if err != nil {
 		return response(msg.ID, false, err.Error(), nil)
 	}
-	return response(msg.ID, true, "ok", nil)
+	content, truncated, err := fsops.ReadArchiveEntry(base, payload.Root, payload.File, payload.Entry, archivePreviewBytes)
+	if err != nil {
+		return response(msg.ID, false, err.Error(), nil)
+	}
+	return response(msg.ID, true, "ok", map[string]interface{}{"content": content, "truncated": truncated})
 }
 
-func (h *Handlers) handleUploadInit(msg protocol.Message) protocol.Message {
+func (h *request) handleUploadInit(msg protocol.Message) protocol.Message {
 	var payload struct {
 		ServerID string `json:"serverId"`
 		Path     string `json:"path"`
 		Size     int64  `json:"size"`
+		SHA256   string `json:"sha256"`
+		Mode     string `json:"mode"`
+		// Overwrite defaults to true, as uploads always replaced files.
+		Overwrite *bool `json:"overwrite"`
 	}
 	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
 		return response(msg.ID, false, "bad payload", nil)
 	}
-	base := fsops.ResolveBase(h.cfg.FileRoot, h.cfg.VolumeMap, h.cfg.ContainerMap, payload.ServerID)
-	uploadID := uuid.NewString()
-	session, err := fsops.NewUpload(base, payload.Path, payload.Size)
+	base, err := h.resolveBase(payload.ServerID)
 	if err != nil {
 		return response(msg.ID, false, err.Error(), nil)
 	}
-	h.uploads[uploadID] = session
-	return response(msg.ID, true, "ok", map[string]string{"uploadId": uploadID})
+	opts := fsops.UploadOptions{
+		SHA256:    payload.SHA256,
+		Mode:      payload.Mode,
+		Overwrite: payload.Overwrite == nil || *payload.Overwrite,
+	}
+	session, err := fsops.NewUpload(base, payload.Path, payload.Size, opts)
+	if err != nil {
+		return response(msg.ID, false, err.Error(), nil)
+	}
+	_, maxUploads, _ := transferSettings(h.cfg.Transfers)
+	uploadID, err := h.uploads.add(payload.ServerID, msg.Scope, session, maxUploads)
+	if err != nil {
+		_ = session.Abort()
+		return response(msg.ID, false, err.Error(), nil)
+	}
+	return response(msg.ID, true, "ok", map[string]interface{}{
+		"uploadId":  uploadID,
+		"chunkSize": session.ChunkSize(),
+		"chunks":    session.Chunks(),
+	})
 }
 
-func (h *Handlers) handleUploadChunk(msg protocol.Message) protocol.Message {
+func (h *request) upload(msg protocol.Message, id string) *fsops.UploadSession {
+	session, _ := h.transfer(msg, h.uploads, id).(*fsops.UploadSession)
+	return session
+}
+
+func (h *request) handleUploadChunk(msg protocol.Message) protocol.Message {
 	var payload struct {
 		UploadID string `json:"uploadId"`
 		Index    int    `json:"index"`
 		Data     string `json:"data"`
+		SHA256   string `json:"sha256"`
 	}
 	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
 		return response(msg.ID, false, "bad payload", nil)
 	}
-	session := h.uploads[payload.UploadID]
+	session := h.upload(msg, payload.UploadID)
 	if session == nil {
 		return response(msg.ID, false, "upload not found", nil)
 	}
@@ -391,100 +708,227 @@ func (h *Handlers) handleUploadChunk(msg protocol.Message) protocol.Message {
 	if err != nil {
 		return response(msg.ID, false, "invalid base64", nil)
 	}
-	if err := session.WriteChunk(payload.Index, bytes); err != nil {
+	if err := session.WriteChunk(payload.Index, bytes, payload.SHA256); err != nil {
 		return response(msg.ID, false, err.Error(), nil)
 	}
-	return response(msg.ID, true, "ok", nil)
+	return response(msg.ID, true, "ok", map[string]int{"index": payload.Index})
 }
 
-func (h *Handlers) handleUploadFinish(msg protocol.Message) protocol.Message {
+func (h *request) handleUploadStatus(msg protocol.Message) protocol.Message {
 	var payload struct {
 		UploadID string `json:"uploadId"`
 	}
 	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
 		return response(msg.ID, false, "bad payload", nil)
 	}
-	session := h.uploads[payload.UploadID]
+	session := h.upload(msg, payload.UploadID)
 	if session == nil {
 		return response(msg.ID, false, "upload not found", nil)
 	}
-	if err := session.Commit(); err != nil {
+	return response(msg.ID, true, "ok", session.Status())
+}
+
+func (h *request) handleUploadFinish(msg protocol.Message) protocol.Message {
+	var payload struct {
+		UploadID string `json:"uploadId"`
+		SHA256   string `json:"sha256"`
+	}
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		return response(msg.ID, false, "bad payload", nil)
+	}
+	session := h.upload(msg, payload.UploadID)
+	if session == nil {
+		return response(msg.ID, false, "upload not found", nil)
+	}
+	sum, err := session.Commit(payload.SHA256)
+	if err != nil {
 		return response(msg.ID, false, err.Error(), nil)
 	}
-	delete(h.uploads, payload.UploadID)
-	return response(msg.ID, true, "ok", nil)
+	h.uploads.remove(payload.UploadID)
+	return response(msg.ID, true, "ok", map[string]string{"sha256": sum})
 }
 
-func (h *Handlers) handleDownloadInit(msg protocol.Message) protocol.Message {
+func (h *request) handleDownloadInit(msg protocol.Message) protocol.Message {
 	var payload struct {
-		ServerID string `json:"serverId"`
-		Path     string `json:"path"`
+		ServerID  string `json:"serverId"`
+		Path      string `json:"path"`
+		ChunkSize int    `json:"chunkSize"`
+		// Archive streams a directory in this format (zip, tar.gz, tar.zst).
+		Archive string `json:"archive"`
 	}
 	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
 		return response(msg.ID, false, "bad payload", nil)
 	}
-	base := fsops.ResolveBase(h.cfg.FileRoot, h.cfg.VolumeMap, h.cfg.ContainerMap, payload.ServerID)
-	session, err := fsops.NewDownload(base, payload.Path)
+	maxChunk := h.maxChunkSize()
+	if payload.ChunkSize == 0 {
+		payload.ChunkSize = min(fsops.DefaultChunkSize, maxChunk)
+	}
+	if payload.ChunkSize < 0 || payload.ChunkSize > maxChunk {
+		return response(msg.ID, false, fmt.Sprintf("chunkSize must be between 1 and %d", maxChunk), nil)
+	}
+	base, err := h.resolveBase(payload.ServerID)
 	if err != nil {
 		return response(msg.ID, false, err.Error(), nil)
 	}
-	return response(msg.ID, true, "ok", map[string]string{"downloadId": session.ID})
+	var session fsops.Download
+	if payload.Archive != "" {
+		session, err = fsops.NewArchiveDownload(base, payload.Path, payload.Archive, payload.ChunkSize)
+	} else {
+		session, err = fsops.NewDownload(base, payload.Path, payload.ChunkSize)
+	}
+	if err != nil {
+		return response(msg.ID, false, err.Error(), nil)
+	}
+	_, _, maxDownloads := transferSettings(h.cfg.Transfers)
+	downloadID, err := h.downloads.add(payload.ServerID, msg.Scope, session, maxDownloads)
+	if err != nil {
+		_ = session.Abort()
+		return response(msg.ID, false, err.Error(), nil)
+	}
+	return response(msg.ID, true, "ok", struct {
+		DownloadID string `json:"downloadId"`
+		fsops.DownloadInfo
+	}{downloadID, session.Info()})
 }
 
-func (h *Handlers) handleDownloadChunk(msg protocol.Message) protocol.Message {
+func (h *request) handleDownloadChunk(msg protocol.Message) protocol.Message {
 	var payload struct {
 		DownloadID string `json:"downloadId"`
 		Index      int    `json:"index"`
+		// Offset and Length request a byte range instead of a chunk index.
+		Offset *int64 `json:"offset"`
+		Length int    `json:"length"`
 	}
 	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
 		return response(msg.ID, false, "bad payload", nil)
 	}
-	chunk, done, err := fsops.ReadChunk(payload.DownloadID, payload.Index)
+	session, _ := h.transfer(msg, h.downloads, payload.DownloadID).(fsops.Download)
+	if session == nil {
+		return response(msg.ID, false, "download not found", nil)
+	}
+	var chunk fsops.DownloadChunk
+	var err error
+	if payload.Offset != nil {
+		if payload.Length == 0 {
+			payload.Length = session.Info().ChunkSize
+		}
+		if maxChunk := h.maxChunkSize(); payload.Length > maxChunk {
+			return response(msg.ID, false, fmt.Sprintf("length must be at most %d", maxChunk), nil)
+		}
+		chunk, err = session.ReadRange(*payload.Offset, payload.Length)
+	} else {
+		chunk, err = session.ReadChunk(payload.Index)
+	}
 	if err != nil {
 		return response(msg.ID, false, err.Error(), nil)
 	}
-	data := base64.StdEncoding.EncodeToString(chunk)
-	return response(msg.ID, true, "ok", map[string]interface{}{
-		"data": data,
-		"done": done,
-	})
+	sum := sha256.Sum256(chunk.Data)
+	data := map[string]interface{}{
+		"data":   base64.StdEncoding.EncodeToString(chunk.Data),
+		"offset": chunk.Offset,
+		"length": len(chunk.Data),
+		"sha256": hex.EncodeToString(sum[:]),
+		"done":   chunk.Done,
+	}
+	if chunk.ArchiveSHA256 != "" {
+		data["archiveSha256"] = chunk.ArchiveSHA256
+	}
+	return response(msg.ID, true, "ok", data)
 }
 
-func (h *Handlers) isActionAllowed(action string) bool {
-	if len(h.cfg.Security.AllowActions) == 0 {
-		return true
+var errUnknownServer = errors.New("unknown server")
+
+// checkServer refuses requests naming a server that has no block in the
+// config, so they cannot slip past per-server settings.
+func (h *request) checkServer(msg protocol.Message) error {
+	var probe struct {
+		ServerID string `json:"serverId"`
 	}
-	for _, a := range h.cfg.Security.AllowActions {
-		if a == action {
-			return true
-		}
+	if json.Unmarshal(msg.Payload, &probe) != nil || probe.ServerID == "" {
+		return nil
 	}
-	return false
+	if !h.cfg.HasServer(probe.ServerID) {
+		return errUnknownServer
+	}
+	return nil
 }
 
-func (h *Handlers) isCommandAllowed(cmd string) bool {
-	if len(h.cfg.Security.CommandAllowlist) == 0 {
+func (h *request) isActionAllowed(msg protocol.Message) bool {
+	if !containsAction(h.cfg.Security.AllowActions, msg.Action) {
+		return false
+	}
+	var probe struct {
+		ServerID string `json:"serverId"`
+	}
+	if json.Unmarshal(msg.Payload, &probe) != nil || probe.ServerID == "" {
 		return true
 	}
-	for _, prefix := range h.cfg.Security.CommandAllowlist {
-		if len(cmd) >= len(prefix) && cmd[:len(prefix)] == prefix {
+	return containsAction(h.cfg.Server(probe.ServerID).AllowActions, msg.Action)
+}
+
+func containsAction(allowed []string, action string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, a := range allowed {
+		if a == action {
 			return true
 		}
 	}
 	return false
 }
 
-func (h *Handlers) resolveContainer(serverId string) string {
-	if v, ok := h.cfg.ContainerMap[serverId]; ok && v != "" {
-		return v
+func (h *request) resolveContainer(serverId string) string {
+	if !h.cfg.HasServer(serverId) {
+		return ""
+	}
+	srv := h.cfg.Server(serverId)
+	if srv.Container != "" {
+		return srv.Container
 	}
 	if h.cfg.ContainerLabelKey == "" {
 		return ""
 	}
-	return dockerexec.FindByLabel(h.cfg.DockerBin, h.cfg.ContainerLabelKey, serverId)
+	return dockerexec.FindByLabel(h.cfg.DockerBin, h.cfg.ContainerLabelKey, srv.Label)
+}
+
+func (h *request) extractLimits() fsops.ExtractLimits {
+	limits := fsops.DefaultExtractLimits
+	cfg := h.cfg.Security.Extract
+	if cfg.MaxBytes > 0 {
+		limits.MaxBytes = cfg.MaxBytes
+	}
+	if cfg.MaxEntries > 0 {
+		limits.MaxEntries = cfg.MaxEntries
+	}
+	if cfg.MaxRatio > 0 {
+		limits.MaxRatio = cfg.MaxRatio
+	}
+	return limits
+}
+
+func (h *request) resolveBase(serverId string) (fsops.Base, error) {
+	if !h.cfg.HasServer(serverId) {
+		return fsops.Base{}, errUnknownServer
+	}
+	srv := h.cfg.Server(serverId)
+	dir, err := fsops.ResolveBase(h.cfg.FileRoot, srv.Volume, srv.Container)
+	if err != nil {
+		return fsops.Base{}, err
+	}
+	return fsops.Base{Dir: dir, Protect: fsops.Protection{
+		ReadDeny:   srv.Protect.ReadDeny,
+		WriteDeny:  srv.Protect.WriteDeny,
+		DeleteDeny: srv.Protect.DeleteDeny,
+	}}, nil
 }
 
 func response(id string, ok bool, msg string, data interface{}) protocol.Message {
 	payload, _ := json.Marshal(protocol.ResponsePayload{Success: ok, Message: msg, Data: data})
 	return protocol.Message{Type: "RES", ID: id, Payload: payload, Ts: time.Now().Unix()}
 }
+
+func responseCode(id, code, msg string) protocol.Message {
+	payload, _ := json.Marshal(protocol.ResponsePayload{Success: false, Code: code, Message: msg})
+	return protocol.Message{Type: "RES", ID: id, Payload: payload, Ts: time.Now().Unix()}
+}
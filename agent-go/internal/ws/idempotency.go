@@ -0,0 +1,136 @@
+package ws
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"minebot-agent/internal/protocol"
+)
+
+const (
+	idempotencyCapacity = 512
+	idempotencyTTL      = 10 * time.Minute
+)
+
+var mutatingActions = map[string]bool{
+	"START":         true,
+	"STOP":          true,
+	"RESTART":       true,
+	"KILL":          true,
+	"COMMAND":       true,
+	"EXEC":          true,
+	"WRITE":         true,
+	"MKDIR":         true,
+	"CHMOD":         true,
+	"DELETE":        true,
+	"RENAME":        true,
+	"COPY":          true,
+	"COMPRESS":      true,
+	"DECOMPRESS":    true,
+	"UPLOAD_INIT":   true,
+	"UPLOAD_FINISH": true,
+	"FETCH_URL":     true,
+}
+
+func isMutating(action string) bool {
+	return mutatingActions[action]
+}
+
+type idempotencyEntry struct {
+	key     string
+	request [sha256.Size]byte
+	payload []byte
+	expires time.Time
+}
+
+type idempotencyCache struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+func newIdempotencyCache(capacity int, ttl time.Duration) *idempotencyCache {
+	return &idempotencyCache{
+		capacity: capacity,
+		ttl:      ttl,
+		order:    list.New(),
+		entries:  map[string]*list.Element{},
+	}
+}
+
+// get returns the cached response for key. The second result is false when
+// nothing is cached; errIdempotencyMismatch means the key was first used
+// with a different request payload.
+func (c *idempotencyCache) get(key string, request [sha256.Size]byte) ([]byte, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	entry := el.Value.(*idempotencyEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return nil, false, nil
+	}
+	if entry.request != request {
+		return nil, false, errIdempotencyMismatch
+	}
+	c.order.MoveToFront(el)
+	return entry.payload, true, nil
+}
+
+func (c *idempotencyCache) put(key string, request [sha256.Size]byte, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*idempotencyEntry)
+		entry.request = request
+		entry.payload = payload
+		entry.expires = time.Now().Add(c.ttl)
+		c.order.MoveToFront(el)
+		return
+	}
+	el := c.order.PushFront(&idempotencyEntry{key: key, request: request, payload: payload, expires: time.Now().Add(c.ttl)})
+	c.entries[key] = el
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*idempotencyEntry).key)
+	}
+}
+
+var errIdempotencyMismatch = errors.New("idempotency key was already used with a different payload")
+
+// requestHash hashes the payload in canonical form (sorted keys, no
+// insignificant whitespace) so that re-encoding a retry does not count as a
+// different request.
+func requestHash(payload json.RawMessage) [sha256.Size]byte {
+	var v interface{}
+	if err := json.Unmarshal(payload, &v); err == nil {
+		if b, err := json.Marshal(v); err == nil {
+			return sha256.Sum256(b)
+		}
+	}
+	return sha256.Sum256(payload)
+}
+
+func idempotencyKey(msg protocol.Message) string {
+	if msg.IdempotencyKey == "" || !isMutating(msg.Action) {
+		return ""
+	}
+	var probe struct {
+		DryRun bool `json:"dryRun"`
+	}
+	if json.Unmarshal(msg.Payload, &probe) == nil && probe.DryRun {
+		return ""
+	}
+	return msg.Scope + ":" + msg.Action + ":" + msg.IdempotencyKey
+}
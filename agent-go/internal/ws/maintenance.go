@@ -0,0 +1,67 @@
+package ws
+
+import (
+	"os"
+
+	"minebot-agent/internal/protocol"
+)
+
+const codeMaintenance = "MAINTENANCE"
+
+// Actions still served while the node is frozen for maintenance.
+var readOnlyActions = map[string]bool{
+	"STATS":          true,
+	"HOST_STATS":     true,
+	"PROCESS_LIST":   true,
+	"LOGS":           true,
+	"LIST":           true,
+	"READ":           true,
+	"ARCHIVE_LIST":   true,
+	"ARCHIVE_READ":   true,
+	"UPLOAD_STATUS":  true,
+	"DOWNLOAD_INIT":  true,
+	"DOWNLOAD_CHUNK": true,
+	"DOWNLOAD_ABORT": true,
+	"EXPLAIN":        true,
+	"AUDIT_QUERY":    true,
+}
+
+// InMaintenance reports whether mutating actions are currently refused,
+// either by config, by the local flag file or by signal.
+func (h *Handlers) InMaintenance() bool {
+	return h.snapshot().inMaintenance()
+}
+
+func (h *request) inMaintenance() bool {
+	if h.cfg.Maintenance.Enabled || h.maintenanceSignal.Load() {
+		return true
+	}
+	_, err := os.Stat(h.cfg.Maintenance.FlagFile)
+	return err == nil
+}
+
+// SetMaintenance sets the signal-driven maintenance override.
+func (h *Handlers) SetMaintenance(on bool) {
+	h.maintenanceSignal.Store(on)
+}
+
+// Capabilities describes what this agent currently accepts; it is sent with
+// AUTH and whenever maintenance mode changes.
+func (h *Handlers) Capabilities() map[string]interface{} {
+	r := h.snapshot()
+	maintenance := r.inMaintenance()
+	actions := []string{}
+	for _, a := range protocol.Actions {
+		if !containsAction(r.cfg.Security.AllowActions, a) {
+			continue
+		}
+		if maintenance && !readOnlyActions[a] {
+			continue
+		}
+		actions = append(actions, a)
+	}
+	return map[string]interface{}{
+		"actions":     actions,
+		"maintenance": maintenance,
+	}
+}
@@ -0,0 +1,116 @@
+package ws
+
+import (
+	"encoding/json"
+	"path"
+
+	"minebot-agent/internal/policy"
+	"minebot-agent/internal/protocol"
+)
+
+// Session follow-ups were already checked when the session was opened.
+var policyExempt = map[string]bool{
+	"UPLOAD_CHUNK":   true,
+	"UPLOAD_FINISH":  true,
+	"UPLOAD_STATUS":  true,
+	"UPLOAD_ABORT":   true,
+	"DOWNLOAD_CHUNK": true,
+	"DOWNLOAD_ABORT": true,
+}
+
+func policyRequest(msg protocol.Message) policy.Request {
+	var payload struct {
+		ServerID    string   `json:"serverId"`
+		Path        string   `json:"path"`
+		Location    string   `json:"location"`
+		Destination string   `json:"destination"`
+		Root        string   `json:"root"`
+		Name        string   `json:"name"`
+		File        string   `json:"file"`
+		From        string   `json:"from"`
+		To          string   `json:"to"`
+		Files       []string `json:"files"`
+		Archive     string   `json:"archive"`
+	}
+	_ = json.Unmarshal(msg.Payload, &payload)
+
+	req := policy.Request{ServerID: payload.ServerID, Action: msg.Action}
+	req.Tree = treeActions[msg.Action] || (msg.Action == "DOWNLOAD_INIT" && payload.Archive != "")
+	if payload.Path != "" {
+		req.Paths = append(req.Paths, payload.Path)
+	}
+	if payload.Location != "" {
+		req.Paths = append(req.Paths, payload.Location)
+	}
+	if payload.Destination != "" {
+		req.Paths = append(req.Paths, payload.Destination)
+	}
+	for _, name := range append([]string{payload.Name, payload.File, payload.From, payload.To}, payload.Files...) {
+		if name != "" {
+			req.Paths = append(req.Paths, path.Join("/", payload.Root, name))
+		}
+	}
+	if len(req.Paths) == 0 && payload.Root != "" {
+		req.Paths = append(req.Paths, payload.Root)
+	}
+	return req
+}
+
+// Tree actions act on everything below their paths, so a deny rule for
+// something inside a directory also covers the directory.
+var treeActions = map[string]bool{
+	"DELETE":   true,
+	"RENAME":   true,
+	"COPY":     true,
+	"COMPRESS": true,
+}
+
+// DELETE and RENAME act on a symlink in the last element instead of
+// following it, so only its own path matters.
+var linkActions = map[string]bool{
+	"DELETE": true,
+	"RENAME": true,
+}
+
+func (h *request) checkPolicy(msg protocol.Message) policy.Decision {
+	if policyExempt[msg.Action] {
+		return policy.Decision{Allowed: true, Rule: -1}
+	}
+	return h.policy.Evaluate(h.resolvedRequest(msg))
+}
+
+// resolvedRequest is policyRequest plus the path each one ends up at once
+// symlinks are followed, so a link cannot carry a request past a rule
+// written for its target. Paths that do not resolve are left for the file
+// action to refuse.
+func (h *request) resolvedRequest(msg protocol.Message) policy.Request {
+	req := policyRequest(msg)
+	if len(req.Paths) == 0 || linkActions[msg.Action] {
+		return req
+	}
+	base, err := h.resolveBase(req.ServerID)
+	if err != nil {
+		return req
+	}
+	for _, p := range req.Paths {
+		if real, err := base.Resolve(p); err == nil && real != path.Clean("/"+p) {
+			req.Paths = append(req.Paths, real)
+		}
+	}
+	return req
+}
+
+func (h *request) handleExplain(msg protocol.Message) protocol.Message {
+	var payload struct {
+		Action  string          `json:"action"`
+		Payload json.RawMessage `json:"payload"`
+	}
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil || payload.Action == "" {
+		return response(msg.ID, false, "bad payload", nil)
+	}
+	req := h.resolvedRequest(protocol.Message{Action: payload.Action, Payload: payload.Payload})
+	return response(msg.ID, true, "ok", map[string]interface{}{
+		"request":  req,
+		"decision": h.policy.Evaluate(req),
+	})
+}
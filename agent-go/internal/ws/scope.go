@@ -0,0 +1,78 @@
+package ws
+
+import (
+	"encoding/json"
+	"errors"
+	"path"
+
+	"minebot-agent/internal/auth"
+	"minebot-agent/internal/config"
+	"minebot-agent/internal/protocol"
+)
+
+func (h *request) checkScope(msg protocol.Message) error {
+	if len(h.cfg.Tokens) == 0 {
+		return nil
+	}
+	if msg.Scope == "" {
+		return errors.New("scope required")
+	}
+	scope := h.scopeToken(msg.Scope)
+	if scope == nil {
+		return errors.New("unknown scope")
+	}
+	if scope.Revoked {
+		return errors.New("scope revoked")
+	}
+	if !auth.Verify(scope.Token, auth.RequestPayload(msg.ID, msg.Action, msg.Ts, msg.Payload), msg.Sig) {
+		return errors.New("invalid scope signature")
+	}
+	if !containsAction(scope.Actions, msg.Action) {
+		return errors.New("action not in scope")
+	}
+	if len(scope.Servers) == 0 {
+		return nil
+	}
+	var probe struct {
+		ServerID string `json:"serverId"`
+	}
+	_ = json.Unmarshal(msg.Payload, &probe)
+	if probe.ServerID == "" || matchServer(scope.Servers, probe.ServerID) {
+		return nil
+	}
+	return errors.New("server not in scope")
+}
+
+func (h *request) scopeToken(name string) *config.TokenConfig {
+	for i := range h.cfg.Tokens {
+		if h.cfg.Tokens[i].Name == name {
+			return &h.cfg.Tokens[i]
+		}
+	}
+	return nil
+}
+
+// scopeServers returns the server patterns the named scope is limited to;
+// nil means any server.
+func (h *request) scopeServers(name string) []string {
+	if scope := h.scopeToken(name); scope != nil {
+		return scope.Servers
+	}
+	return nil
+}
+
+// serverInScope reports whether the named scope may act on serverID. It is
+// used for requests that reach a server indirectly, through a session id.
+func (h *request) serverInScope(name, serverID string) bool {
+	servers := h.scopeServers(name)
+	return len(servers) == 0 || matchServer(servers, serverID)
+}
+
+func matchServer(patterns []string, serverID string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, serverID); ok {
+			return true
+		}
+	}
+	return false
+}
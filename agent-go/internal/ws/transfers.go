@@ -0,0 +1,237 @@
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"minebot-agent/internal/config"
+	"minebot-agent/internal/fsops"
+	"minebot-agent/internal/protocol"
+)
+
+const (
+	defaultTransferIdle   = 10 * time.Minute
+	defaultMaxUploads     = 4
+	defaultMaxDownloads   = 8
+	defaultMaxChunkSize   = 4 << 20
+	transferSweepInterval = 30 * time.Second
+)
+
+type transferSession interface {
+	Abort() error
+}
+
+// transfer is an open session and who owns it: the server it was opened
+// for and the scope that opened it.
+type transfer struct {
+	serverID string
+	scope    string
+	session  transferSession
+	lastUsed time.Time
+}
+
+// transferTable tracks open upload or download sessions by id.
+type transferTable struct {
+	kind     string
+	mu       sync.Mutex
+	sessions map[string]*transfer
+}
+
+func newTransferTable(kind string) *transferTable {
+	return &transferTable{kind: kind, sessions: map[string]*transfer{}}
+}
+
+// add registers s unless serverID already has limit open sessions.
+func (t *transferTable) add(serverID, scope string, s transferSession, limit int) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	open := 0
+	for _, tr := range t.sessions {
+		if tr.serverID == serverID {
+			open++
+		}
+	}
+	if open >= limit {
+		return "", fmt.Errorf("too many open %ss for this server (limit %d)", t.kind, limit)
+	}
+	id := uuid.NewString()
+	t.sessions[id] = &transfer{serverID: serverID, scope: scope, session: s, lastUsed: time.Now()}
+	return id, nil
+}
+
+// get returns the session and its server if scope opened it, and marks it
+// as used.
+func (t *transferTable) get(id, scope string) (transferSession, string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tr := t.sessions[id]
+	if tr == nil || tr.scope != scope {
+		return nil, ""
+	}
+	tr.lastUsed = time.Now()
+	return tr.session, tr.serverID
+}
+
+func (t *transferTable) remove(id string) transferSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tr := t.sessions[id]
+	if tr == nil {
+		return nil
+	}
+	delete(t.sessions, id)
+	return tr.session
+}
+
+// expire aborts and drops sessions idle for longer than idle.
+func (t *transferTable) expire(idle time.Duration) {
+	cutoff := time.Now().Add(-idle)
+	var stale []transferSession
+	t.mu.Lock()
+	for id, tr := range t.sessions {
+		if tr.lastUsed.Before(cutoff) {
+			stale = append(stale, tr.session)
+			delete(t.sessions, id)
+			log.Printf("%s %s expired after %s idle", t.kind, id, idle)
+		}
+	}
+	t.mu.Unlock()
+	for _, s := range stale {
+		if err := s.Abort(); err != nil {
+			log.Printf("%s cleanup failed: %v", t.kind, err)
+		}
+	}
+}
+
+// staged is a session writing to a staged file.
+type staged interface {
+	TempPath() string
+}
+
+// tempPaths adds the staged files of open sessions to keep.
+func (t *transferTable) tempPaths(keep map[string]bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, tr := range t.sessions {
+		if s, ok := tr.session.(staged); ok {
+			keep[s.TempPath()] = true
+		}
+	}
+}
+
+func transferSettings(cfg config.TransferConfig) (idle time.Duration, maxUploads, maxDownloads int) {
+	idle, maxUploads, maxDownloads = defaultTransferIdle, defaultMaxUploads, defaultMaxDownloads
+	if cfg.IdleTimeoutSec > 0 {
+		idle = time.Duration(cfg.IdleTimeoutSec) * time.Second
+	}
+	if cfg.MaxUploadsPerServer > 0 {
+		maxUploads = cfg.MaxUploadsPerServer
+	}
+	if cfg.MaxDownloadsPerServer > 0 {
+		maxDownloads = cfg.MaxDownloadsPerServer
+	}
+	return idle, maxUploads, maxDownloads
+}
+
+// maxChunkSize is the largest download chunk or range a client may ask for.
+func (h *request) maxChunkSize() int {
+	if n := h.cfg.Transfers.MaxChunkSize; n > 0 {
+		return n
+	}
+	return defaultMaxChunkSize
+}
+
+// SweepTransfers expires idle upload and download sessions, and deletes
+// staged files no session owns, at startup and then until the process
+// exits.
+func (h *Handlers) SweepTransfers() {
+	h.sweepStaging()
+	ticker := time.NewTicker(transferSweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		h.cfgMu.RLock()
+		idle, _, _ := transferSettings(h.cfg.Transfers)
+		h.cfgMu.RUnlock()
+		h.uploads.expire(idle)
+		h.downloads.expire(idle)
+		h.sweepStaging()
+	}
+}
+
+// sweepStaging removes staged files left in every server directory by
+// uploads and fetches that never finished, e.g. before a crash. Files
+// written within the last sweep interval are kept, so one being created
+// for a session that is not registered yet survives.
+func (h *Handlers) sweepStaging() {
+	cfg := h.snapshot().cfg
+	keep := map[string]bool{}
+	h.uploads.tempPaths(keep)
+	h.fetches.tempPaths(keep)
+
+	dirs := map[string]bool{}
+	if len(cfg.Servers) == 0 {
+		dirs[cfg.FileRoot] = true
+	}
+	for _, srv := range cfg.Servers {
+		if dir, err := fsops.ResolveBase(cfg.FileRoot, srv.Volume, srv.Container); err == nil {
+			dirs[dir] = true
+		}
+	}
+	for dir := range dirs {
+		n, err := fsops.SweepStaging(dir, keep, transferSweepInterval)
+		if err != nil {
+			log.Printf("staging cleanup in %s failed: %v", dir, err)
+		} else if n > 0 {
+			log.Printf("removed %d stale staged files in %s", n, dir)
+		}
+	}
+}
+
+func (h *request) handleUploadAbort(msg protocol.Message) protocol.Message {
+	var payload struct {
+		UploadID string `json:"uploadId"`
+	}
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		return response(msg.ID, false, "bad payload", nil)
+	}
+	return h.abortTransfer(msg, h.uploads, payload.UploadID)
+}
+
+func (h *request) handleDownloadAbort(msg protocol.Message) protocol.Message {
+	var payload struct {
+		DownloadID string `json:"downloadId"`
+	}
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		return response(msg.ID, false, "bad payload", nil)
+	}
+	return h.abortTransfer(msg, h.downloads, payload.DownloadID)
+}
+
+// transfer returns the session id in table when the requesting scope owns
+// it and may still act on its server. Sessions of other scopes look absent.
+func (h *request) transfer(msg protocol.Message, table *transferTable, id string) transferSession {
+	session, serverID := table.get(id, msg.Scope)
+	if session == nil || !h.serverInScope(msg.Scope, serverID) {
+		return nil
+	}
+	return session
+}
+
+func (h *request) abortTransfer(msg protocol.Message, table *transferTable, id string) protocol.Message {
+	if h.transfer(msg, table, id) == nil {
+		return response(msg.ID, false, table.kind+" not found", nil)
+	}
+	session := table.remove(id)
+	if session == nil {
+		return response(msg.ID, false, table.kind+" not found", nil)
+	}
+	if err := session.Abort(); err != nil {
+		return response(msg.ID, false, err.Error(), nil)
+	}
+	return response(msg.ID, true, "ok", nil)
+}